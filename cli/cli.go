@@ -0,0 +1,379 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	defaultMount         = "google"
+	defaultListenAddress = "127.0.0.1"
+	defaultPort          = "8250"
+	callbackPath         = "/oauth2/callback"
+
+	// how long to wait for the browser to be redirected to the listener
+	callbackTimeout = 5 * time.Minute
+
+	callbackSuccessHTML = `<!DOCTYPE html>
+<html><head><title>Vault Login</title></head>
+<body><p>Login successful, you can close this window and return to the CLI.</p></body></html>
+`
+)
+
+// CLIHandler implements the login handler of the vault CLI for the Google
+// auth method.
+type CLIHandler struct {
+	// for tests
+	testStdout  io.Writer
+	testStdin   io.Reader
+	testOpenURL func(string) error
+}
+
+type callbackResult struct {
+	code string
+	err  error
+}
+
+func (h *CLIHandler) Auth(c *api.Client, m map[string]string) (*api.Secret, error) {
+	mount, ok := m["mount"]
+	if !ok {
+		mount = defaultMount
+	}
+
+	listenAddress, ok := m["listen_address"]
+	if !ok {
+		listenAddress = defaultListenAddress
+	}
+
+	port, ok := m["port"]
+	if !ok {
+		port = defaultPort
+	}
+
+	headless, err := parseBool(m, "headless")
+	if err != nil {
+		return nil, err
+	}
+
+	skipBrowser, err := parseBool(m, "skip_browser")
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := parseBool(m, "device")
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := h.testStdout
+	if stdout == nil {
+		stdout = os.Stderr
+	}
+
+	if device {
+		return deviceLogin(c, mount, m, stdout)
+	}
+
+	var listener net.Listener
+	var redirectURI string
+	if !headless {
+		listener, err = net.Listen("tcp", net.JoinHostPort(listenAddress, port))
+		if err != nil {
+			fmt.Fprintf(stdout, "Unable to listen for the login callback, falling back to entering the code manually: %s\n", err)
+			headless = true
+		} else {
+			defer listener.Close()
+			redirectURI = fmt.Sprintf("http://%s%s", listener.Addr().String(), callbackPath)
+		}
+	}
+
+	// request the URL of the code flow
+	data := map[string][]string{}
+	if redirectURI != "" {
+		data["redirect_uri"] = []string{redirectURI}
+	}
+	secret, err := c.Logical().ReadWithData(fmt.Sprintf("auth/%s/cli_code_url", mount), data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from credential provider")
+	}
+	authURL, _ := secret.Data["url"].(string)
+	state, _ := secret.Data["state"].(string)
+	if authURL == "" || state == "" {
+		return nil, errors.New("credential provider returned no code URL")
+	}
+
+	fmt.Fprintf(stdout, "Complete the login via your browser:\n\n    %s\n\n", authURL)
+
+	var code string
+	if headless {
+		stdin := h.testStdin
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+
+		fmt.Fprintf(stdout, "Enter the authorization code: ")
+		code, err = bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !(err == io.EOF && code != "") {
+			return nil, fmt.Errorf("error reading the authorization code: %s", err)
+		}
+		code = strings.TrimSpace(code)
+	} else {
+		results := make(chan callbackResult, 1)
+		server := &http.Server{Handler: callbackHandler(state, results)}
+		go server.Serve(listener)
+		defer server.Shutdown(context.Background())
+
+		if !skipBrowser {
+			openURL := h.testOpenURL
+			if openURL == nil {
+				openURL = openBrowser
+			}
+			if err := openURL(authURL); err != nil {
+				fmt.Fprintf(stdout, "Unable to open the browser, open the URL manually: %s\n", err)
+			}
+		}
+
+		fmt.Fprintf(stdout, "Waiting for the login to complete...\n")
+
+		select {
+		case result := <-results:
+			if result.err != nil {
+				return nil, result.err
+			}
+			code = result.code
+		case <-time.After(callbackTimeout):
+			return nil, errors.New("timed out waiting for the login to complete")
+		}
+	}
+
+	if code == "" {
+		return nil, errors.New("no authorization code provided")
+	}
+
+	loginData := map[string]interface{}{
+		"code":  code,
+		"state": state,
+	}
+	if redirectURI != "" {
+		loginData["redirect_uri"] = redirectURI
+	}
+	if role, ok := m["role"]; ok {
+		loginData["role"] = role
+	}
+
+	secret, err = c.Logical().Write(fmt.Sprintf("auth/%s/login", mount), loginData)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from credential provider")
+	}
+
+	return secret, nil
+}
+
+// deviceLogin starts the device flow and retries the login until the user
+// approved the request on another device.
+func deviceLogin(c *api.Client, mount string, m map[string]string, stdout io.Writer) (*api.Secret, error) {
+	secret, err := c.Logical().Write(fmt.Sprintf("auth/%s/device_code", mount), nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from credential provider")
+	}
+	deviceCode, _ := secret.Data["device_code"].(string)
+	userCode, _ := secret.Data["user_code"].(string)
+	verificationURL, _ := secret.Data["verification_url"].(string)
+	if deviceCode == "" || userCode == "" || verificationURL == "" {
+		return nil, errors.New("credential provider returned no device code")
+	}
+	expires := time.Now().Add(seconds(secret.Data["expires_in"]))
+
+	fmt.Fprintf(stdout, "Complete the login on another device by visiting:\n\n    %s\n\nand entering the code %s\n\n", verificationURL, userCode)
+	fmt.Fprintf(stdout, "Waiting for the login to complete...\n")
+
+	loginData := map[string]interface{}{
+		"device_code": deviceCode,
+	}
+	if role, ok := m["role"]; ok {
+		loginData["role"] = role
+	}
+
+	for {
+		secret, err = c.Logical().Write(fmt.Sprintf("auth/%s/login", mount), loginData)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			return nil, errors.New("empty response from credential provider")
+		}
+		if secret.Auth != nil {
+			return secret, nil
+		}
+
+		// the request hasn't been approved yet
+		if _, ok := secret.Data["status"]; !ok {
+			return nil, errors.New("credential provider returned no token")
+		}
+		interval := seconds(secret.Data["interval"])
+		if time.Now().Add(interval).After(expires) {
+			return nil, errors.New("timed out waiting for the login to complete")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// seconds parses a number of seconds of a response
+func seconds(value interface{}) time.Duration {
+	var n int64
+	switch v := value.(type) {
+	case json.Number:
+		n, _ = v.Int64()
+	case float64:
+		n = int64(v)
+	}
+	return time.Duration(n) * time.Second
+}
+
+// callbackHandler receives the redirect of the browser and sends the
+// authorization code to the results channel.
+func callbackHandler(state string, results chan<- callbackResult) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var result callbackResult
+		switch {
+		case query.Get("error") != "":
+			result.err = fmt.Errorf("login failed: %s", query.Get("error"))
+		case query.Get("state") != state:
+			result.err = errors.New("login failed: state mismatch")
+		case query.Get("code") == "":
+			result.err = errors.New("login failed: no authorization code received")
+		default:
+			result.code = query.Get("code")
+		}
+
+		if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadRequest)
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, callbackSuccessHTML)
+		}
+
+		// only the first callback is handled
+		select {
+		case results <- result:
+		default:
+		}
+	})
+	return mux
+}
+
+// openBrowser opens the URL in the default browser
+func openBrowser(url string) error {
+	var cmd string
+	var args []string
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = "open"
+	case "windows":
+		cmd = "rundll32"
+		args = []string{"url.dll,FileProtocolHandler"}
+	default:
+		cmd = "xdg-open"
+	}
+
+	return exec.Command(cmd, append(args, url)...).Start()
+}
+
+func parseBool(m map[string]string, key string) (bool, error) {
+	value, ok := m[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %s", key, err)
+	}
+	return b, nil
+}
+
+func (h *CLIHandler) Help() string {
+	help := `
+Usage: vault login -method=google [CONFIG K=V...]
+
+  The Google auth method allows users to authenticate using their Google
+  account. The login URL is opened in the default browser and the redirect
+  after a successful login is received by a listener on the loopback
+  interface.
+
+  Authenticate using Google:
+
+      $ vault login -method=google role=hello
+
+  Authenticate on a machine without a browser, the authorization code needs
+  to be pasted into the CLI:
+
+      $ vault login -method=google headless=true
+
+  Authenticate by approving the login on another device, e.g. a phone:
+
+      $ vault login -method=google device=true
+
+Configuration:
+
+  mount=<string>
+      Path where the Google credential method is mounted. This is usually
+      provided via the -path flag in the "vault login" command, but it can be
+      specified here as well. If specified here, it takes precedence over the
+      value for -path. The default value is "google".
+
+  role=<string>
+      Role to login with. If not provided, the default role of the auth method
+      is used.
+
+  headless=<bool>
+      Don't run a listener for the redirect of the browser and prompt for the
+      authorization code instead. The default value is false.
+
+  device=<bool>
+      Use the device flow, which shows a code to enter on another device
+      instead of a login URL. Requires the device client of the auth method.
+      The default value is false.
+
+  skip_browser=<bool>
+      Only print the login URL instead of opening it in the default browser.
+      The default value is false.
+
+  listen_address=<string>
+      Loopback address of the listener receiving the redirect. The default
+      value is "127.0.0.1".
+
+  port=<string>
+      Port of the listener receiving the redirect, "0" selects a random port.
+      The default value is "8250".
+`
+
+	return strings.TrimSpace(help)
+}
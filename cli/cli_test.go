@@ -0,0 +1,253 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeVault emulates the code URL and login endpoints of the auth method
+type fakeVault struct {
+	t           *testing.T
+	redirectURI string
+	login       map[string]interface{}
+
+	// device logins pending before the user approves
+	devicePending int
+	deviceLogins  int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+
+	switch r.URL.Path {
+	case "/v1/auth/my-google/cli_code_url":
+		f.redirectURI = r.URL.Query().Get("redirect_uri")
+		authURL := url.URL{Scheme: "https", Host: "accounts.google.com", Path: "/o/oauth2/auth"}
+		authURL.RawQuery = url.Values{"state": {"my-state"}, "redirect_uri": {f.redirectURI}}.Encode()
+		resp = map[string]interface{}{
+			"data": map[string]interface{}{
+				"url":   authURL.String(),
+				"state": "my-state",
+			},
+		}
+	case "/v1/auth/my-google/login":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.t.Fatalf("unable to read body: %s", err)
+		}
+		if err := json.Unmarshal(body, &f.login); err != nil {
+			f.t.Fatalf("unable to decode body: %s", err)
+		}
+		if _, ok := f.login["device_code"]; ok {
+			f.deviceLogins++
+			if f.deviceLogins <= f.devicePending {
+				resp = map[string]interface{}{
+					"data": map[string]interface{}{
+						"device_code": "my-device-code",
+						"status":      "authorization_pending",
+						"interval":    0,
+					},
+				}
+				break
+			}
+		}
+		resp = map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token": "my-token",
+			},
+		}
+	case "/v1/auth/my-google/device_code":
+		resp = map[string]interface{}{
+			"data": map[string]interface{}{
+				"device_code":      "my-device-code",
+				"user_code":        "ABCD-EFGH",
+				"verification_url": "https://www.google.com/device",
+				"expires_in":       60,
+				"interval":         0,
+			},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		f.t.Errorf("unable to encode response: %s", err)
+	}
+}
+
+func newTestClient(t *testing.T, f *fakeVault) (*api.Client, func()) {
+	server := httptest.NewServer(f)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("unable to create client: %s", err)
+	}
+	client.SetToken("")
+
+	return client, server.Close
+}
+
+func TestCLIHandler_Loopback(t *testing.T) {
+	f := &fakeVault{t: t}
+	client, cleanup := newTestClient(t, f)
+	defer cleanup()
+
+	var stdout strings.Builder
+	h := &CLIHandler{
+		testStdout: &stdout,
+		// the browser redirects to the listener after a successful login
+		testOpenURL: func(authURL string) error {
+			u, err := url.Parse(authURL)
+			if err != nil {
+				return err
+			}
+			redirectURI := u.Query().Get("redirect_uri")
+			go func() {
+				resp, err := http.Get(fmt.Sprintf("%s?state=my-state&code=my-code", redirectURI))
+				if err != nil {
+					t.Errorf("unable to call redirect uri: %s", err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("unexpected status code of redirect: %d", resp.StatusCode)
+				}
+			}()
+			return nil
+		},
+	}
+
+	secret, err := h.Auth(client, map[string]string{
+		"mount": "my-google",
+		"role":  "hello",
+		"port":  "0",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if exp, act := "my-token", secret.Auth.ClientToken; exp != act {
+		t.Errorf("unexpected token: exp=%s act=%s", exp, act)
+	}
+	if !strings.HasPrefix(f.redirectURI, "http://127.0.0.1:") || !strings.HasSuffix(f.redirectURI, callbackPath) {
+		t.Errorf("unexpected redirect uri: %s", f.redirectURI)
+	}
+	for key, exp := range map[string]string{
+		"code":         "my-code",
+		"state":        "my-state",
+		"role":         "hello",
+		"redirect_uri": f.redirectURI,
+	} {
+		if act := f.login[key]; exp != act {
+			t.Errorf("unexpected login parameter %s: exp=%s act=%v", key, exp, act)
+		}
+	}
+}
+
+func TestCLIHandler_Headless(t *testing.T) {
+	f := &fakeVault{t: t}
+	client, cleanup := newTestClient(t, f)
+	defer cleanup()
+
+	var stdout strings.Builder
+	h := &CLIHandler{
+		testStdout: &stdout,
+		testStdin:  strings.NewReader("my-pasted-code\n"),
+		testOpenURL: func(string) error {
+			t.Errorf("browser should not be opened")
+			return nil
+		},
+	}
+
+	if _, err := h.Auth(client, map[string]string{
+		"mount":    "my-google",
+		"headless": "true",
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if f.redirectURI != "" {
+		t.Errorf("unexpected redirect uri: %s", f.redirectURI)
+	}
+	if exp, act := "my-pasted-code", f.login["code"]; exp != act {
+		t.Errorf("unexpected code: exp=%s act=%v", exp, act)
+	}
+	if _, ok := f.login["redirect_uri"]; ok {
+		t.Errorf("unexpected redirect uri in login")
+	}
+	if !strings.Contains(stdout.String(), "Enter the authorization code") {
+		t.Errorf("expected prompt for the code, got: %s", stdout.String())
+	}
+}
+
+func TestCLIHandler_Device(t *testing.T) {
+	f := &fakeVault{t: t, devicePending: 2}
+	client, cleanup := newTestClient(t, f)
+	defer cleanup()
+
+	var stdout strings.Builder
+	h := &CLIHandler{
+		testStdout: &stdout,
+		testOpenURL: func(string) error {
+			t.Errorf("browser should not be opened")
+			return nil
+		},
+	}
+
+	secret, err := h.Auth(client, map[string]string{
+		"mount":  "my-google",
+		"role":   "hello",
+		"device": "true",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if exp, act := "my-token", secret.Auth.ClientToken; exp != act {
+		t.Errorf("unexpected token: exp=%s act=%s", exp, act)
+	}
+	// the login is retried while it's pending
+	if exp, act := 3, f.deviceLogins; exp != act {
+		t.Errorf("unexpected device logins: exp=%d act=%d", exp, act)
+	}
+	for key, exp := range map[string]string{
+		"device_code": "my-device-code",
+		"role":        "hello",
+	} {
+		if act := f.login[key]; exp != act {
+			t.Errorf("unexpected login parameter %s: exp=%s act=%v", key, exp, act)
+		}
+	}
+	if !strings.Contains(stdout.String(), "https://www.google.com/device") || !strings.Contains(stdout.String(), "ABCD-EFGH") {
+		t.Errorf("expected verification url and user code, got: %s", stdout.String())
+	}
+}
+
+func TestCLIHandler_CallbackStateMismatch(t *testing.T) {
+	results := make(chan callbackResult, 1)
+	server := httptest.NewServer(callbackHandler("my-state", results))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + callbackPath + "?state=other-state&code=my-code")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	if exp, act := http.StatusBadRequest, resp.StatusCode; exp != act {
+		t.Errorf("unexpected status code: exp=%d act=%d", exp, act)
+	}
+	if result := <-results; result.err == nil || !strings.Contains(result.err.Error(), "state mismatch") {
+		t.Errorf("expected state mismatch, got: %v", result.err)
+	}
+}
@@ -4,10 +4,14 @@ go 1.13
 
 require (
 	github.com/golang/mock v1.4.3
+	github.com/hashicorp/go-cleanhttp v0.5.1
+	github.com/hashicorp/go-multierror v1.0.0
 	github.com/hashicorp/go-uuid v1.0.2
 	github.com/hashicorp/vault v1.4.3
 	github.com/hashicorp/vault/api v1.0.5-0.20200317185738-82f498082f02
 	github.com/hashicorp/vault/sdk v0.1.14-0.20200702114606-96dd7d6e10db
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	google.golang.org/api v0.14.0
+	gopkg.in/square/go-jose.v2 v2.4.1
 )
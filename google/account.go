@@ -0,0 +1,55 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+	goauth "google.golang.org/api/oauth2/v2"
+)
+
+// validateAccount looks up the directory account of the user and checks it's
+// still active, returns nil if account validation is not configured
+func (b *backend) validateAccount(ctx context.Context, config *config, user *goauth.Userinfoplus) (*admin.User, error) {
+	if !config.ValidateAccountStatus && !config.Require2SV && len(config.AllowedOrgUnits) == 0 {
+		return nil, nil
+	}
+
+	if !config.directoryConfigured() {
+		return nil, errors.New("validating the account of the user requires directory_impersonate_user and directory_service_account_key or directory_service_account_email")
+	}
+
+	account, err := b.account.lookupUser(ctx, config, user.Email)
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return nil, errors.New("account of the user no longer exists")
+	}
+	if err != nil {
+		b.Logger().Warn("querying the admin directory API for the account of the user failed", "user", user.Email, "error", err)
+		return nil, errors.New("unable to look up the account of the user")
+	}
+
+	if account.Suspended {
+		return nil, errors.New("account of the user is suspended")
+	}
+
+	if account.Archived {
+		return nil, errors.New("account of the user is archived")
+	}
+
+	if config.Require2SV && !account.IsEnrolledIn2Sv {
+		return nil, errors.New("user is not enrolled in 2-step verification")
+	}
+
+	return account, nil
+}
+
+// orgUnitContains returns if the org unit path is the org unit or one of its
+// sub units
+func orgUnitContains(orgUnit, path string) bool {
+	orgUnit = strings.ToLower(strings.TrimSuffix(orgUnit, "/"))
+	path = strings.ToLower(path)
+	return path == orgUnit || strings.HasPrefix(path, orgUnit+"/")
+}
@@ -26,20 +26,34 @@ Documentation can be found at https://github.com/grapeshot/google-auth-vault-plu
 func newBackend() *backend {
 	gp := &googleProvider{}
 	b := &backend{
-		user:   gp,
-		groups: gp,
+		user:          gp,
+		groups:        gp,
+		cloudIdentity: &cloudIdentityProvider{},
+		account:       gp,
+		jwks:          newJWKSCache(),
+
+		groupsCache:         newGroupsCache(),
+		keyringCache:        &keyringCache{},
+		accessPatternsCache: &accessPatternsCache{},
 	}
 
 	b.Backend = &framework.Backend{
-		BackendType: logical.TypeCredential,
-		AuthRenew:   b.pathRenew,
-		Help:        googleBackendHelp,
+		BackendType:  logical.TypeCredential,
+		AuthRenew:    b.pathRenew,
+		Invalidate:   b.invalidate,
+		PeriodicFunc: b.revokeExpiredGrants,
+		Help:         googleBackendHelp,
 
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{
 				loginPath,
 				cliCodeURLPath,
 				webCodeURLPath,
+				deviceCodePath,
+			},
+			SealWrapStorage: []string{
+				grantEntry,
+				keyringEntry,
 			},
 		},
 
@@ -51,6 +65,16 @@ func newBackend() *backend {
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.UpdateOperation: b.pathConfigWrite,
 					logical.ReadOperation:   b.pathConfigRead,
+					logical.DeleteOperation: b.pathConfigDelete,
+				},
+			},
+
+			{
+				Pattern: configImportPath,
+				Fields:  configImportPathFields(),
+
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathConfigImport,
 				},
 			},
 
@@ -59,12 +83,28 @@ func newBackend() *backend {
 				Fields: map[string]*framework.FieldSchema{
 					googleAuthCodeParameterName: &framework.FieldSchema{
 						Type:        framework.TypeString,
-						Description: "Google authentication code. Required.",
+						Description: "Google authentication code. Required, unless a jwt is supplied.",
+					},
+					jwtParameterName: {
+						Type:        framework.TypeString,
+						Description: "Google-signed OpenID Connect ID token, which is verified instead of exchanging a code. Optional.",
 					},
 					stateParameterName: {
 						Type:        framework.TypeString,
 						Description: "State parameter used by web login. If used the web method is used. Optional.",
 					},
+					deviceCodeParameterName: {
+						Type:        framework.TypeString,
+						Description: "Device code returned by the device_code endpoint. The login waits for the user to approve the request, if it's still pending the login needs to be retried. Optional.",
+					},
+					redirectURIParameterName: {
+						Type:        framework.TypeString,
+						Description: "Redirect URI used to request the CLI code URL. Required, if one was used.",
+					},
+					roleParameterName: {
+						Type:        framework.TypeString,
+						Description: "Role to login with, defaults to the configured default role. Optional.",
+					},
 				},
 
 				Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -75,7 +115,12 @@ func newBackend() *backend {
 
 			{
 				Pattern: cliCodeURLPath,
-				Fields:  map[string]*framework.FieldSchema{},
+				Fields: map[string]*framework.FieldSchema{
+					redirectURIParameterName: {
+						Type:        framework.TypeString,
+						Description: "Loopback redirect URI (http://127.0.0.1:<port>) of a listener run by the CLI. Optional.",
+					},
+				},
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.ReadOperation: b.pathCLICodeURL,
 				},
@@ -88,7 +133,33 @@ func newBackend() *backend {
 					logical.ReadOperation: b.pathWebCodeURL,
 				},
 			},
-		}),
+
+			{
+				Pattern: deviceCodePath,
+				Fields:  map[string]*framework.FieldSchema{},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathDeviceCode,
+					logical.UpdateOperation: b.pathDeviceCode,
+				},
+			},
+
+			{
+				Pattern: explainPath,
+				Fields:  explainPathFields(),
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathExplain,
+					logical.UpdateOperation: b.pathExplain,
+				},
+			},
+
+			{
+				Pattern: keyringRotatePath,
+				Fields:  map[string]*framework.FieldSchema{},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.UpdateOperation: b.pathKeyringRotate,
+				},
+			},
+		}, pathsRole(b)...),
 	}
 
 	return b
@@ -98,6 +169,35 @@ type backend struct {
 	Map *framework.PolicyMap
 	*framework.Backend
 
-	user   UserProvider
-	groups GroupsProvider
+	user          UserProvider
+	groups        GroupsProvider
+	cloudIdentity GroupsProvider
+	account       AccountProvider
+
+	jwks *jwksCache
+
+	groupsCache         *groupsCache
+	keyringCache        *keyringCache
+	accessPatternsCache *accessPatternsCache
+}
+
+// invalidate flushes cached data, when the config was changed on another node
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch key {
+	case configEntry:
+		b.groupsCache.flush()
+		b.accessPatternsCache.flush()
+		b.resetClients()
+	case keyringEntry:
+		b.keyringCache.flush()
+	}
+}
+
+// resetClients drops the API clients the providers created from the config
+func (b *backend) resetClients() {
+	for _, provider := range []interface{}{b.user, b.groups, b.cloudIdentity, b.account} {
+		if r, ok := provider.(clientResetter); ok {
+			r.resetClients()
+		}
+	}
 }
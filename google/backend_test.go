@@ -2,18 +2,34 @@ package google
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	logicaltest "github.com/hashicorp/vault/helper/testhelpers/logical"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
 	goauth "google.golang.org/api/oauth2/v2"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 type expectFunc func(*logical.Response) error
@@ -112,35 +128,40 @@ func TestBackend_CodeURL(t *testing.T) {
 		webRedirectURLConfigPropertyName:  "https://thefuck.com/callback",
 	}
 
-	webFine := testCodeURLRead(t, webCodeURLPath, false, func(resp *logical.Response) error {
-		u, err := url.Parse(resp.Data["url"].(string))
-		if err != nil {
-			t.Errorf("failed to parse url: %s", err)
-		}
+	expectWebURL := func(mountPath string) expectFunc {
+		return func(resp *logical.Response) error {
+			u, err := url.Parse(resp.Data["url"].(string))
+			if err != nil {
+				t.Errorf("failed to parse url: %s", err)
+			}
 
-		stateData := resp.Data["state"].(string)
-		stateURL := u.Query().Get("state")
+			stateData := resp.Data["state"].(string)
+			stateURL := u.Query().Get("state")
 
-		if len(stateData) == 0 {
-			t.Errorf("state in data is empty")
-		}
+			if len(stateData) == 0 {
+				t.Errorf("state in data is empty")
+			}
 
-		if len(stateURL) == 0 {
-			t.Errorf("state in URL is empty")
-		}
+			if len(stateURL) == 0 {
+				t.Errorf("state in URL is empty")
+			}
 
-		if exp, act := stateURL, stateData; exp != act {
-			t.Errorf("state mismatches: url=%s data=%s", exp, act)
-		}
+			if exp, act := stateURL, stateData; exp != act {
+				t.Errorf("state mismatches: url=%s data=%s", exp, act)
+			}
 
-		if exp, act := "web-id", u.Query().Get("client_id"); exp != act {
-			t.Errorf("unexpected client id in url: exp=%s act=%s", exp, act)
-		}
-		if exp, act := "https://thefuck.com/callback/ui/vault/auth/google/callback/google", u.Query().Get("redirect_uri"); exp != act {
-			t.Errorf("unexpected redirect uri in url: exp=%s act=%s", exp, act)
+			if exp, act := "web-id", u.Query().Get("client_id"); exp != act {
+				t.Errorf("unexpected client id in url: exp=%s act=%s", exp, act)
+			}
+			if exp, act := "https://thefuck.com/callback/ui/vault/auth/google/callback/"+mountPath, u.Query().Get("redirect_uri"); exp != act {
+				t.Errorf("unexpected redirect uri in url: exp=%s act=%s", exp, act)
+			}
+			return nil
 		}
-		return nil
-	})
+	}
+
+	// mounted at auth/mnt by the test case
+	webFine := testCodeURLRead(t, webCodeURLPath, false, expectWebURL("mnt"))
 
 	bothConfigData := map[string]interface{}{
 		cliClientIDConfigPropertyName:     "cli-id",
@@ -151,7 +172,7 @@ func TestBackend_CodeURL(t *testing.T) {
 	}
 
 	logicaltest.Test(t, logicaltest.TestCase{
-		LogicalBackend: b,
+		CredentialBackend: b,
 		Steps: []logicaltest.TestStep{
 			testConfigWrite(t, noConfigData),
 			cliMissing,
@@ -167,6 +188,30 @@ func TestBackend_CodeURL(t *testing.T) {
 			webFine,
 		},
 	})
+
+	// the default mount path is used, if the request has no mount point
+	s := &logical.InmemStorage{}
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, webConfigData); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	for mountPoint, mountPath := range map[string]string{
+		"":             "google",
+		"auth/google/": "google",
+		"auth/other/":  "other",
+	} {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:  logical.ReadOperation,
+			Path:       webCodeURLPath,
+			MountPoint: mountPoint,
+			Storage:    s,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := expectWebURL(mountPath)(resp); err != nil {
+			t.Error(err)
+		}
+	}
 }
 
 func expectFailWithError(subString string) expectFunc {
@@ -276,8 +321,8 @@ func TestBackend_Login(t *testing.T) {
 		},
 	}
 
-	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq("my-web-code"), webClientIDMatcher).Times(1).Return(webToken, nil)
-	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Eq(webToken)).Times(1).Return(webUser, nil)
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq("my-web-code"), webClientIDMatcher, gomock.Any()).Times(1).Return(webToken, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(webToken)).Times(1).Return(webUser, nil)
 	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("me-web@my.com")).Times(1).Return(webGroups, nil)
 
 	var webState = &struct{ State string }{}
@@ -325,15 +370,19 @@ func TestBackend_Login(t *testing.T) {
 		},
 	}
 
-	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq("my-cli-code"), cliClientIDMatcher).Times(1).Return(cliToken, nil)
-	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Eq(cliToken)).Times(1).Return(cliUser, nil)
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq("my-cli-code"), cliClientIDMatcher, gomock.Any()).Times(1).Return(cliToken, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(cliToken)).Times(1).Return(cliUser, nil)
 	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq("my-cli-code-nostate"), cliClientIDMatcher).Times(1).Return(cliTokenNoState, nil)
-	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Eq(cliTokenNoState)).Times(1).Return(cliUser, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(cliTokenNoState)).Times(1).Return(cliUser, nil)
 	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("me-cli@my.com")).Times(2).Return(cliGroups, nil)
 
 	var cliState = &struct{ State string }{}
 	cliFine := testCodeURLRead(t, cliCodeURLPath, false, func(resp *logical.Response) error {
 		cliState.State = resp.Data["state"].(string)
+		// the login might not supply the state with the code verifier
+		if strings.Contains(resp.Data[codeURLResponsePropertyName].(string), "code_challenge") {
+			return fmt.Errorf("unexpected PKCE challenge in the code url")
+		}
 		return nil
 	})
 
@@ -364,7 +413,7 @@ func TestBackend_Login(t *testing.T) {
 	)
 
 	logicaltest.Test(t, logicaltest.TestCase{
-		LogicalBackend: b,
+		CredentialBackend: b,
 		Steps: []logicaltest.TestStep{
 			testConfigWrite(t, configData),
 			checkConfigRead,
@@ -417,9 +466,9 @@ func TestBackend_LoginAuthorisation(t *testing.T) {
 	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(userA.Email), gomock.Any()).AnyTimes().Return(&oauth2.Token{AccessToken: userA.Email}, nil)
 	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(userB.Email), gomock.Any()).AnyTimes().Return(&oauth2.Token{AccessToken: userB.Email}, nil)
 	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(userC.Email), gomock.Any()).AnyTimes().Return(&oauth2.Token{AccessToken: userC.Email}, nil)
-	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userA.Email})).AnyTimes().Return(userA, nil)
-	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userB.Email})).AnyTimes().Return(userB, nil)
-	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userC.Email})).AnyTimes().Return(userC, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userA.Email})).AnyTimes().Return(userA, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userB.Email})).AnyTimes().Return(userB, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userC.Email})).AnyTimes().Return(userC, nil)
 
 	groupsUserA := []*admin.Group{groupA, groupAB, groupABC}
 	groupsUserB := []*admin.Group{groupAB, groupABC}
@@ -450,11 +499,11 @@ func TestBackend_LoginAuthorisation(t *testing.T) {
 		cliClientIDConfigPropertyName:                "cli-id",
 		cliClientSecretConfigPropertyName:            "cli-secret",
 		directoryImpersonateUserConfigPropertyName:   "myadmin@user.com",
-		directoryServiceAccountKeyConfigPropertyName: "secret",
+		directoryServiceAccountKeyConfigPropertyName: testServiceAccountKey(t, "http://127.0.0.1/token"),
 	}
 
 	logicaltest.Test(t, logicaltest.TestCase{
-		LogicalBackend: b,
+		CredentialBackend: b,
 		Steps: []logicaltest.TestStep{
 			// test defaults, every one allowed
 			testConfigWrite(t, configData),
@@ -494,13 +543,185 @@ func TestBackend_LoginAuthorisation(t *testing.T) {
 			loginUser(userA, true),
 			loginUser(userB, true),
 			loginUser(userC, true),
+			// patterns
+			testConfigWrite(t, map[string]interface{}{
+				allowedUsersConfigPropertyName:   "glob:B@*",
+				allowedDomainsConfigPropertyName: "",
+				allowedGroupsConfigPropertyName:  "",
+			}),
+			loginUser(userA, false),
+			loginUser(userB, true),
+			loginUser(userC, false),
+			testConfigWrite(t, map[string]interface{}{
+				allowedUsersConfigPropertyName:   "",
+				allowedDomainsConfigPropertyName: `re:(a|x)\.com`,
+				allowedGroupsConfigPropertyName:  "",
+			}),
+			loginUser(userA, true),
+			loginUser(userB, false),
+			loginUser(userC, false),
+			testConfigWrite(t, map[string]interface{}{
+				allowedUsersConfigPropertyName:   "",
+				allowedDomainsConfigPropertyName: "",
+				allowedGroupsConfigPropertyName:  "glob:group-a?@a.com",
+			}),
+			loginUser(userA, true),
+			loginUser(userB, true),
+			loginUser(userC, false),
+			// denied lists take precedence
+			testConfigWrite(t, map[string]interface{}{
+				allowedUsersConfigPropertyName:   "",
+				allowedDomainsConfigPropertyName: "a.com,b.com",
+				allowedGroupsConfigPropertyName:  "",
+				deniedUsersConfigPropertyName:    userC.Email,
+			}),
+			loginUser(userA, true),
+			loginUser(userB, true),
+			loginUser(userC, false),
+			testConfigWrite(t, map[string]interface{}{
+				deniedUsersConfigPropertyName:  "",
+				deniedGroupsConfigPropertyName: groupA.Email,
+			}),
+			loginUser(userA, false),
+			loginUser(userB, true),
+			loginUser(userC, true),
+			// without allowed lists
+			testConfigWrite(t, map[string]interface{}{
+				allowedDomainsConfigPropertyName: "",
+				deniedGroupsConfigPropertyName:   "",
+				deniedDomainsConfigPropertyName:  "glob:b.*",
+			}),
+			loginUser(userA, true),
+			loginUser(userB, false),
+			loginUser(userC, false),
 		},
 	})
 }
 
+// tests exact, glob and regular expression entries
+func TestPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{"a@corp.com", "A@Corp.com", true},
+		{"a@corp.com", "ba@corp.com", false},
+		{"*-oncall@corp.com", "team-oncall@corp.com", false},
+		{"glob:*-oncall@corp.com", "team-oncall@corp.com", true},
+		{"glob:*-oncall@corp.com", "team-oncall@corp.com.evil.com", false},
+		{"glob:team-*@corp.com", "Team-A@corp.com", true},
+		{"glob:team-*@corp.com", "teamA@corp.com", false},
+		{"glob:*.corp.com", "eu.corp.com", true},
+		{"glob:*.corp.com", "corp.com", false},
+		{"glob:*.corp.com", "eucorp.com", false},
+		{"glob:a?@corp.com", "ab@corp.com", true},
+		{`re:(eng|ops)-.+@corp\.com`, "ops-team@corp.com", true},
+		{`re:(eng|ops)-.+@corp\.com`, "sales-team@corp.com", false},
+		{`re:corp\.com`, "evilcorp.com", false},
+	} {
+		p, err := compilePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("unexpected error compiling %q: %s", tc.pattern, err)
+			continue
+		}
+		if match := p.match(tc.value); match != tc.match {
+			t.Errorf("pattern %q matching %q, exp=%v act=%v", tc.pattern, tc.value, tc.match, match)
+		}
+	}
+
+	if _, err := compilePattern("re:(unclosed"); err == nil {
+		t.Error("expected error compiling invalid regular expression")
+	}
+}
+
+// tests that logins reuse the patterns compiled from the stored config
+func TestBackend_AccessPatternsCache(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return([]*admin.Group{}, nil)
+
+	writeConfig := func(d map[string]interface{}) error {
+		_, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, d)
+		return err
+	}
+	login := func() *accessPatterns {
+		if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: "code",
+		}); err != nil {
+			t.Fatalf("unexpected login error: %s", err)
+		}
+		return b.accessPatternsCache.access
+	}
+
+	if err := writeConfig(map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		allowedUsersConfigPropertyName:    "glob:*@a.com",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	first := login()
+	if first == nil {
+		t.Fatal("expected the patterns to be cached")
+	}
+	if second := login(); second != first {
+		t.Error("expected the second login to reuse the compiled patterns")
+	}
+	c, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.access != first {
+		t.Error("expected the loaded config to use the compiled patterns")
+	}
+
+	// invalid patterns are rejected on write, the cache is kept
+	if err := writeConfig(map[string]interface{}{
+		allowedUsersConfigPropertyName: "re:(unclosed",
+	}); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("expected invalid pattern to be rejected, got: %v", err)
+	}
+	if b.accessPatternsCache.access != first {
+		t.Error("expected the cached patterns to be kept")
+	}
+
+	// writes and invalidations flush the cache
+	if err := writeConfig(map[string]interface{}{
+		allowedUsersConfigPropertyName: "glob:a@*",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	if b.accessPatternsCache.access != nil {
+		t.Error("expected the config write to flush the cached patterns")
+	}
+	updated := login()
+	if updated == nil || updated == first {
+		t.Error("expected the patterns to be compiled from the new config")
+	}
+	b.invalidate(ctx, configEntry)
+	if b.accessPatternsCache.access != nil {
+		t.Error("expected the invalidation to flush the cached patterns")
+	}
+}
+
 type oauth2ConfigClientIDMatcher struct {
-	t        *testing.T
-	clientID string
+	t           *testing.T
+	clientID    string
+	redirectURL string
 }
 
 func (o *oauth2ConfigClientIDMatcher) Matches(obj interface{}) bool {
@@ -513,6 +734,10 @@ func (o *oauth2ConfigClientIDMatcher) Matches(obj interface{}) bool {
 		o.t.Logf("unexpected client ID exp=%s act=%s", o.clientID, c.ClientID)
 		return false
 	}
+	if o.redirectURL != "" && c.RedirectURL != o.redirectURL {
+		o.t.Logf("unexpected redirect URL exp=%s act=%s", o.redirectURL, c.RedirectURL)
+		return false
+	}
 	return true
 }
 
@@ -542,3 +767,2747 @@ func testLoginWrite(t *testing.T, d map[string]interface{}, state *struct{ State
 		},
 	}
 }
+
+func testRoleWrite(t *testing.T, name string, d map[string]interface{}, expects ...expectFunc) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      rolePath + name,
+		Data:      d,
+		ErrorOk:   len(expects) > 0,
+		Check: func(resp *logical.Response) error {
+			for _, f := range expects {
+				if err := f(resp); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// test role creation, listing and deletion
+func TestBackend_Role(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	readRole := func(name string, expects ...expectFunc) logicaltest.TestStep {
+		return logicaltest.TestStep{
+			Operation: logical.ReadOperation,
+			Path:      rolePath + name,
+			Check: func(resp *logical.Response) error {
+				for _, f := range expects {
+					if err := f(resp); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+
+	listRoles := func(exp ...string) logicaltest.TestStep {
+		return logicaltest.TestStep{
+			Operation: logical.ListOperation,
+			Path:      rolePath,
+			Check: func(resp *logical.Response) error {
+				var act []string
+				if keys, ok := resp.Data["keys"]; ok {
+					act = keys.([]string)
+				}
+				if exp, act := strings.Join(exp, ","), strings.Join(act, ","); exp != act {
+					return fmt.Errorf("unexpected roles: exp=%s act=%s", exp, act)
+				}
+				return nil
+			},
+		}
+	}
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		CredentialBackend: b,
+		Steps: []logicaltest.TestStep{
+			listRoles(),
+			testRoleWrite(t, "hello", map[string]interface{}{
+				boundDomainsRolePropertyName: "my.com",
+				boundEmailsRolePropertyName:  "a@my.com,b@my.com",
+				policiesRolePropertyName:     "Hello,world",
+				ttlRolePropertyName:          "10m",
+			}),
+			testRoleWrite(t, "other", map[string]interface{}{
+				boundGroupsRolePropertyName: "other@my.com",
+				policiesRolePropertyName:    "other",
+			}),
+			testRoleWrite(t, "unbound", map[string]interface{}{
+				policiesRolePropertyName: "unbound",
+			}, expectFailWithError("at least one of bound_domains, bound_emails, bound_groups, bound_service_accounts or bound_projects is required")),
+			testRoleWrite(t, "broken", map[string]interface{}{
+				boundDomainsRolePropertyName: "my.com",
+				ttlRolePropertyName:          "2h",
+				maxTTLRolePropertyName:       "1h",
+			}, expectFailWithError("ttl must not be greater than max_ttl")),
+			listRoles("hello", "other"),
+			readRole("hello", func(resp *logical.Response) error {
+				if exp, act := "a@my.com,b@my.com", strings.Join(resp.Data[boundEmailsRolePropertyName].([]string), ","); exp != act {
+					return fmt.Errorf("unexpected bound emails: exp=%s act=%s", exp, act)
+				}
+				if exp, act := "hello,world", strings.Join(resp.Data[policiesRolePropertyName].([]string), ","); exp != act {
+					return fmt.Errorf("unexpected policies: exp=%s act=%s", exp, act)
+				}
+				if exp, act := (10 * time.Minute).String(), resp.Data[ttlRolePropertyName].(string); exp != act {
+					return fmt.Errorf("unexpected ttl: exp=%s act=%s", exp, act)
+				}
+				return nil
+			}),
+			{
+				Operation: logical.DeleteOperation,
+				Path:      rolePath + "other",
+			},
+			listRoles("hello"),
+		},
+	})
+}
+
+// tests the role bindings, policies and TTLs as part of the login
+func TestBackend_LoginRole(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	groupA := &admin.Group{
+		Name:  "Group A",
+		Email: "group-a@a.com",
+	}
+
+	userA := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	userB := &goauth.Userinfoplus{
+		Email: "b@b.com",
+		Hd:    "b.com",
+	}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(userA.Email), gomock.Any()).AnyTimes().Return(&oauth2.Token{AccessToken: userA.Email}, nil)
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(userB.Email), gomock.Any()).AnyTimes().Return(&oauth2.Token{AccessToken: userB.Email}, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userA.Email})).AnyTimes().Return(userA, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(&oauth2.Token{AccessToken: userB.Email})).AnyTimes().Return(userB, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(userA.Email)).AnyTimes().Return([]*admin.Group{groupA}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(userB.Email)).AnyTimes().Return([]*admin.Group{}, nil)
+
+	loginUser := func(u *goauth.Userinfoplus, roleName string, expects ...expectFunc) logicaltest.TestStep {
+		d := map[string]interface{}{
+			googleAuthCodeParameterName: u.Email,
+		}
+		if roleName != "" {
+			d[roleParameterName] = roleName
+		}
+		step := testLoginWrite(t, d, nil, false, expects...)
+		step.ErrorOk = true
+		return step
+	}
+
+	expectPolicies := func(policies ...string) expectFunc {
+		return func(resp *logical.Response) error {
+			if resp.IsError() {
+				return resp.Error()
+			}
+			if !policyutil.EquivalentPolicies(policies, resp.Auth.Policies) {
+				return fmt.Errorf("unexpected policies: exp=%v act=%v", policies, resp.Auth.Policies)
+			}
+			return nil
+		}
+	}
+
+	expectTTL := func(ttl time.Duration) expectFunc {
+		return func(resp *logical.Response) error {
+			if exp, act := ttl, resp.Auth.TTL; exp != act {
+				return fmt.Errorf("unexpected ttl: exp=%s act=%s", exp, act)
+			}
+			return nil
+		}
+	}
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		CredentialBackend: b,
+		Steps: []logicaltest.TestStep{
+			testConfigWrite(t, map[string]interface{}{
+				cliClientIDConfigPropertyName:     "cli-id",
+				cliClientSecretConfigPropertyName: "cli-secret",
+				cliTTLConfigPropertyName:          "1h",
+			}),
+			testRoleWrite(t, "domain", map[string]interface{}{
+				boundDomainsRolePropertyName: userA.Hd,
+				policiesRolePropertyName:     "domain",
+				ttlRolePropertyName:          "10m",
+			}),
+			testRoleWrite(t, "group", map[string]interface{}{
+				boundGroupsRolePropertyName: groupA.Email,
+				policiesRolePropertyName:    "group",
+			}),
+			testRoleWrite(t, "emails", map[string]interface{}{
+				boundEmailsRolePropertyName:  userB.Email,
+				boundDomainsRolePropertyName: userB.Hd,
+				policiesRolePropertyName:     "emails",
+			}),
+			// no role, no policies
+			loginUser(userA, "", expectPolicies(), expectTTL(time.Hour)),
+			loginUser(userA, "domain", expectPolicies("domain"), expectTTL(10*time.Minute)),
+			loginUser(userA, "group", expectPolicies("group"), expectTTL(time.Hour)),
+			loginUser(userA, "emails", expectFailWithError(`user is not allowed to login with role "emails"`)),
+			loginUser(userB, "domain", expectFailWithError(`user is not allowed to login with role "domain"`)),
+			loginUser(userB, "group", expectFailWithError(`user is not allowed to login with role "group"`)),
+			loginUser(userB, "emails", expectPolicies("emails")),
+			loginUser(userB, "missing", expectFailWithError(`role "missing" could not be found`)),
+			// default role
+			testConfigWrite(t, map[string]interface{}{
+				defaultRoleConfigPropertyName: "group",
+			}),
+			loginUser(userA, "", expectPolicies("group")),
+			loginUser(userB, "", expectFailWithError(`user is not allowed to login with role "group"`)),
+			loginUser(userB, "emails", expectPolicies("emails")),
+			// the role bindings replace the allowed lists, the denied lists
+			// still apply
+			testConfigWrite(t, map[string]interface{}{
+				defaultRoleConfigPropertyName:    "",
+				allowedDomainsConfigPropertyName: userA.Hd,
+			}),
+			loginUser(userA, "", expectPolicies()),
+			loginUser(userB, "", expectFailWithError("user is not allowed to login")),
+			loginUser(userB, "emails", expectPolicies("emails")),
+			testConfigWrite(t, map[string]interface{}{
+				deniedUsersConfigPropertyName: userB.Email,
+			}),
+			loginUser(userB, "emails", expectFailWithError("user is not allowed to login")),
+			loginUser(userA, "domain", expectPolicies("domain")),
+		},
+	})
+}
+
+// handle a request against the backend directly, returns the response or the
+// error of the response
+func testHandleRequest(t *testing.T, b *backend, s logical.Storage, op logical.Operation, path string, d map[string]interface{}) (*logical.Response, error) {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Data:      d,
+		Storage:   s,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil && resp.IsError() {
+		return resp, resp.Error()
+	}
+	return resp, nil
+}
+
+// renew the auth of a previous login
+func testRenew(t *testing.T, b *backend, s logical.Storage, auth *logical.Auth) (*logical.Response, error) {
+	auth.TokenPolicies = auth.Policies
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Path:      loginPath,
+		Auth:      auth,
+		Storage:   s,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil && resp.IsError() {
+		return resp, resp.Error()
+	}
+	return resp, nil
+}
+
+// tests that renewals re-check the role of the login
+func TestBackend_RenewRole(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(user.Email), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).AnyTimes().Return([]*admin.Group{}, nil)
+
+	for _, step := range []struct {
+		path string
+		data map[string]interface{}
+	}{
+		{configPath, map[string]interface{}{
+			cliClientIDConfigPropertyName:     "cli-id",
+			cliClientSecretConfigPropertyName: "cli-secret",
+		}},
+		{rolePath + "hello", map[string]interface{}{
+			boundDomainsRolePropertyName: user.Hd,
+			policiesRolePropertyName:     "hello",
+			ttlRolePropertyName:          "10m",
+		}},
+	} {
+		if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, step.path, step.data); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", step.path, err)
+		}
+	}
+
+	resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		googleAuthCodeParameterName: user.Email,
+		roleParameterName:           "hello",
+	})
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	auth := resp.Auth
+
+	if _, err := testRenew(t, b, s, auth); err != nil {
+		t.Errorf("unexpected renew error: %s", err)
+	}
+
+	// change the policies of the role
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, rolePath+"hello", map[string]interface{}{
+		policiesRolePropertyName: "hello,world",
+	}); err != nil {
+		t.Fatalf("unexpected error writing role: %s", err)
+	}
+	if _, err := testRenew(t, b, s, auth); err == nil || !strings.Contains(err.Error(), "policies of role \"hello\" have changed") {
+		t.Errorf("expected renew to fail as policies changed, got: %v", err)
+	}
+
+	// remove the role
+	if _, err := testHandleRequest(t, b, s, logical.DeleteOperation, rolePath+"hello", nil); err != nil {
+		t.Fatalf("unexpected error deleting role: %s", err)
+	}
+	if _, err := testRenew(t, b, s, auth); err == nil || !strings.Contains(err.Error(), "role \"hello\" no longer exists") {
+		t.Errorf("expected renew to fail as role is gone, got: %v", err)
+	}
+}
+
+type testJWTSigner struct {
+	t      *testing.T
+	key    *rsa.PrivateKey
+	signer jose.Signer
+}
+
+func newTestJWTSigner(t *testing.T, kid string) *testJWTSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid),
+	)
+	if err != nil {
+		t.Fatalf("unable to create signer: %s", err)
+	}
+
+	return &testJWTSigner{t: t, key: key, signer: signer}
+}
+
+func (s *testJWTSigner) sign(claims ...interface{}) string {
+	builder := jwt.Signed(s.signer)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+	token, err := builder.CompactSerialize()
+	if err != nil {
+		s.t.Fatalf("unable to sign token: %s", err)
+	}
+	return token
+}
+
+// serve the public keys of the signers as JWKS
+func newTestJWKSServer(t *testing.T, signers map[string]*testJWTSigner) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keySet jose.JSONWebKeySet
+		for kid, s := range signers {
+			keySet.Keys = append(keySet.Keys, jose.JSONWebKey{
+				Key:       s.key.Public(),
+				KeyID:     kid,
+				Algorithm: string(jose.RS256),
+				Use:       "sig",
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		if err := json.NewEncoder(w).Encode(&keySet); err != nil {
+			t.Errorf("unable to encode JWKS: %s", err)
+		}
+	}))
+}
+
+// tests the login with Google-signed ID tokens
+func TestBackend_LoginJWT(t *testing.T) {
+	ctrl, _, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	signer := newTestJWTSigner(t, "key-1")
+	otherSigner := newTestJWTSigner(t, "key-1")
+	server := newTestJWKSServer(t, map[string]*testJWTSigner{"key-1": signer})
+	defer server.Close()
+
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("a@a.com")).AnyTimes().Return([]*admin.Group{
+		{Name: "Group A", Email: "group-a@a.com"},
+	}, nil)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		cliTTLConfigPropertyName:          "1h",
+		jwksURLConfigPropertyName:         server.URL,
+		allowedGroupsConfigPropertyName:   "group-a@a.com",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	now := time.Now()
+	claims := func(modify func(*jwt.Claims, map[string]interface{})) (*jwt.Claims, map[string]interface{}) {
+		c := &jwt.Claims{
+			Issuer:   "https://accounts.google.com",
+			Subject:  "1234",
+			Audience: jwt.Audience{"cli-id"},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		}
+		private := map[string]interface{}{
+			"email":          "a@a.com",
+			"email_verified": true,
+			"hd":             "a.com",
+			"given_name":     "A",
+			"family_name":    "Aa",
+		}
+		if modify != nil {
+			modify(c, private)
+		}
+		return c, private
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		expErr string
+	}{
+		{
+			name:   "malformed",
+			token:  "not-a-jwt",
+			expErr: "error parsing ID token",
+		},
+		{
+			name: "wrong signature",
+			token: func() string {
+				c, p := claims(nil)
+				return otherSigner.sign(c, p)
+			}(),
+			expErr: "error verifying ID token",
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				c, p := claims(func(c *jwt.Claims, _ map[string]interface{}) { c.Issuer = "https://evil.com" })
+				return signer.sign(c, p)
+			}(),
+			expErr: "unexpected ID token issuer",
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				c, p := claims(func(c *jwt.Claims, _ map[string]interface{}) { c.Audience = jwt.Audience{"other-id"} })
+				return signer.sign(c, p)
+			}(),
+			expErr: "ID token audience is not allowed",
+		},
+		{
+			name: "expired",
+			token: func() string {
+				c, p := claims(func(c *jwt.Claims, _ map[string]interface{}) { c.Expiry = jwt.NewNumericDate(now.Add(-time.Hour)) })
+				return signer.sign(c, p)
+			}(),
+			expErr: "token is expired",
+		},
+		{
+			name: "email not verified",
+			token: func() string {
+				c, p := claims(func(_ *jwt.Claims, p map[string]interface{}) { p["email_verified"] = "false" })
+				return signer.sign(c, p)
+			}(),
+			expErr: "email of ID token is not verified",
+		},
+		{
+			name: "no hosted domain",
+			token: func() string {
+				c, p := claims(func(_ *jwt.Claims, p map[string]interface{}) { delete(p, "hd") })
+				return signer.sign(c, p)
+			}(),
+			expErr: "ID token is not issued for a G Suite account",
+		},
+		{
+			name: "valid",
+			token: func() string {
+				c, p := claims(nil)
+				return signer.sign(c, p)
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+				jwtParameterName: tc.token,
+			})
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Errorf("expected error containing '%s', got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if exp, act := "a@a.com", resp.Auth.Alias.Name; exp != act {
+				t.Errorf("unexpected alias: exp=%s act=%s", exp, act)
+			}
+			if exp, act := time.Hour, resp.Auth.TTL; exp != act {
+				t.Errorf("unexpected ttl: exp=%s act=%s", exp, act)
+			}
+			if _, ok := resp.Auth.InternalData["token"]; ok {
+				t.Errorf("unexpected oauth2 token for ID token login")
+			}
+
+			// renewals check the authorisation of the user again
+			if _, err := testRenew(t, b, s, resp.Auth); err != nil {
+				t.Errorf("unexpected renew error: %s", err)
+			}
+			if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+				allowedGroupsConfigPropertyName: "group-b@a.com",
+			}); err != nil {
+				t.Fatalf("unexpected error writing config: %s", err)
+			}
+			if _, err := testRenew(t, b, s, resp.Auth); err == nil || !strings.Contains(err.Error(), "user is not allowed to login") {
+				t.Errorf("expected renew to fail, got: %v", err)
+			}
+		})
+	}
+}
+
+// tests concurrent logins share a single key set fetch, which isn't canceled
+// by its caller, and that stale key sets are used if refreshing them fails
+func TestBackend_JWKSCache(t *testing.T) {
+	signer := newTestJWTSigner(t, "key-1")
+	keys := newTestJWKSServer(t, map[string]*testJWTSigner{"key-1": signer})
+	defer keys.Close()
+
+	var lock sync.Mutex
+	requests := 0
+	failing := false
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		lock.Lock()
+		requests++
+		fail := failing
+		lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		keys.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	expectRequests := func(exp int) {
+		lock.Lock()
+		defer lock.Unlock()
+		if act := requests; exp != act {
+			t.Errorf("unexpected JWKS requests: exp=%d act=%d", exp, act)
+		}
+	}
+
+	c := newJWKSCache()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.key(canceled, server.URL, "key-1"); err != context.Canceled {
+		t.Errorf("expected canceled error, got: %v", err)
+	}
+
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := c.key(context.Background(), server.URL, "key-1")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	expectRequests(1)
+
+	expire := func(d time.Duration) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.entries[server.URL].expires = time.Now().Add(-d)
+	}
+
+	lock.Lock()
+	failing = true
+	lock.Unlock()
+
+	// the expired key set is used while the refresh fails
+	expire(time.Minute)
+	if _, err := c.key(context.Background(), server.URL, "key-1"); err != nil {
+		t.Errorf("expected stale key set to be used, got: %s", err)
+	}
+	expectRequests(2)
+
+	// until it's expired for too long
+	expire(jwksStaleDuration + time.Minute)
+	if _, err := c.key(context.Background(), server.URL, "key-1"); err == nil || !strings.Contains(err.Error(), "unexpected status code 503") {
+		t.Errorf("expected fetch error, got: %v", err)
+	}
+	expectRequests(3)
+}
+
+// tests the device authorization grant
+func TestBackend_LoginDevice(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	defer func(increment, maxWait time.Duration) {
+		deviceSlowDownIncrement, deviceLoginMaxWait = increment, maxWait
+	}(deviceSlowDownIncrement, deviceLoginMaxWait)
+	deviceSlowDownIncrement = 400 * time.Millisecond
+	deviceLoginMaxWait = 500 * time.Millisecond
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: "device-access-token", RefreshToken: "device-refresh-token"}
+	deviceClientIDMatcher := &oauth2ConfigClientIDMatcher{clientID: "device-id", t: t}
+
+	userMock.EXPECT().deviceAuth(gomock.Any(), deviceClientIDMatcher, gomock.Eq(defaultDeviceAuthURL)).Times(2).Return(&deviceAuth{
+		DeviceCode:      "google-device-code",
+		UserCode:        "ABCD-EFGH",
+		VerificationURL: "https://www.google.com/device",
+		ExpiresIn:       time.Minute,
+		Interval:        200 * time.Millisecond,
+	}, nil)
+	gomock.InOrder(
+		userMock.EXPECT().deviceToken(gomock.Any(), deviceClientIDMatcher, "google-device-code").Times(2).Return(nil, &oauth2Error{Code: "authorization_pending"}),
+		userMock.EXPECT().deviceToken(gomock.Any(), deviceClientIDMatcher, "google-device-code").Times(1).Return(nil, &oauth2Error{Code: "slow_down"}),
+		userMock.EXPECT().deviceToken(gomock.Any(), deviceClientIDMatcher, "google-device-code").Times(1).Return(token, nil),
+		userMock.EXPECT().deviceToken(gomock.Any(), deviceClientIDMatcher, "google-device-code").Times(1).Return(nil, &oauth2Error{Code: "access_denied"}),
+	)
+	// once for the alias lookahead and once for the login
+	userMock.EXPECT().authUser(gomock.Any(), deviceClientIDMatcher, gomock.Any(), gomock.Eq(token)).Times(2).Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return([]*admin.Group{}, nil)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, deviceCodePath, nil); err == nil || !strings.Contains(err.Error(), "missing config for device oauth2 client") {
+		t.Errorf("expected missing config error, got: %v", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		deviceClientIDConfigPropertyName:     "device-id",
+		deviceClientSecretConfigPropertyName: "device-secret",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	startDevice := func() string {
+		resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, deviceCodePath, nil)
+		if err != nil {
+			t.Fatalf("unexpected error starting device flow: %s", err)
+		}
+		if exp, act := "ABCD-EFGH", resp.Data[userCodeResponsePropertyName]; exp != act {
+			t.Errorf("unexpected user code: exp=%s act=%s", exp, act)
+		}
+		if exp, act := "https://www.google.com/device", resp.Data[verificationURLPropertyName]; exp != act {
+			t.Errorf("unexpected verification url: exp=%s act=%s", exp, act)
+		}
+		deviceCode := resp.Data[deviceCodeParameterName].(string)
+		if deviceCode == "" || deviceCode == "google-device-code" {
+			t.Errorf("unexpected device code: %s", deviceCode)
+		}
+		return deviceCode
+	}
+
+	deviceCode := startDevice()
+	login := func(op logical.Operation) (*logical.Response, error) {
+		return testHandleRequest(t, b, s, op, loginPath, map[string]interface{}{
+			deviceCodeParameterName: deviceCode,
+		})
+	}
+	expectPending := func(resp *logical.Response, err error, status string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unexpected login error: %s", err)
+		}
+		if resp.Auth != nil {
+			t.Fatalf("unexpected auth of pending login: %+v", resp.Auth)
+		}
+		if exp, act := status, resp.Data[statusResponsePropertyName]; exp != act {
+			t.Errorf("unexpected status: exp=%s act=%v", exp, act)
+		}
+		if exp, act := deviceCode, resp.Data[deviceCodeParameterName]; exp != act {
+			t.Errorf("unexpected device code: exp=%s act=%v", exp, act)
+		}
+		if exp, act := int64(1), resp.Data[intervalResponsePropertyName]; exp != act {
+			t.Errorf("unexpected interval: exp=%d act=%v", exp, act)
+		}
+	}
+
+	// the login polls every interval, until slow_down increases the interval
+	// beyond the maximum wait
+	start := time.Now()
+	resp, err := login(logical.UpdateOperation)
+	expectPending(resp, err, "slow_down")
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected the login to poll for 400ms, returned after %s", elapsed)
+	}
+
+	// alias lookaheads don't wait for the interval
+	resp, err = login(logical.AliasLookaheadOperation)
+	expectPending(resp, err, "authorization_pending")
+
+	// nor use up the device code
+	time.Sleep(600 * time.Millisecond)
+	resp, err = login(logical.AliasLookaheadOperation)
+	if err != nil {
+		t.Fatalf("unexpected alias lookahead error: %s", err)
+	}
+	if resp.Auth == nil || resp.Auth.Alias == nil || resp.Auth.Alias.Name != user.Email {
+		t.Fatalf("unexpected alias lookahead response: %+v", resp)
+	}
+	if len(resp.Auth.InternalData) > 0 {
+		t.Errorf("unexpected internal data of alias lookahead: %+v", resp.Auth.InternalData)
+	}
+
+	resp, err = login(logical.UpdateOperation)
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	if exp, act := typeDevice, resp.Auth.InternalData["type"]; exp != act {
+		t.Errorf("unexpected auth type: exp=%s act=%s", exp, act)
+	}
+
+	if _, err := login(logical.UpdateOperation); err == nil || !strings.Contains(err.Error(), "this device code can't be found or has already been used") {
+		t.Errorf("expected device code to be used, got: %v", err)
+	}
+
+	deviceCode = startDevice()
+	if _, err := login(logical.UpdateOperation); err == nil || !strings.Contains(err.Error(), "device authorization failed: access_denied") {
+		t.Errorf("expected access to be denied, got: %v", err)
+	}
+}
+
+// tests that code logins use PKCE
+func TestBackend_LoginPKCE(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		requirePKCEConfigPropertyName:     true,
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	resp, err := testHandleRequest(t, b, s, logical.ReadOperation, cliCodeURLPath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error getting code url: %s", err)
+	}
+	u, err := url.Parse(resp.Data[codeURLResponsePropertyName].(string))
+	if err != nil {
+		t.Fatalf("failed to parse url: %s", err)
+	}
+	stateValue := resp.Data[stateParameterName].(string)
+
+	stateObj, err := b.state(context.Background(), &logical.Request{Storage: s}, b.statePath(stateValue))
+	if err != nil || stateObj == nil {
+		t.Fatalf("unable to read state: %v", err)
+	}
+	if len(stateObj.CodeVerifier) < 43 {
+		t.Errorf("code verifier is too short: %s", stateObj.CodeVerifier)
+	}
+	if exp, act := "S256", u.Query().Get("code_challenge_method"); exp != act {
+		t.Errorf("unexpected code challenge method: exp=%s act=%s", exp, act)
+	}
+	if exp, act := pkceChallenge(stateObj.CodeVerifier), u.Query().Get("code_challenge"); exp != act {
+		t.Errorf("unexpected code challenge: exp=%s act=%s", exp, act)
+	}
+	if strings.Contains(u.String(), stateObj.CodeVerifier) {
+		t.Errorf("code verifier is part of the url")
+	}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), "my-code", gomock.Any(), gomock.Eq(oauth2.SetAuthURLParam("code_verifier", stateObj.CodeVerifier))).Times(1).Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).Times(1).Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return([]*admin.Group{}, nil)
+
+	// logins without state are rejected
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		googleAuthCodeParameterName: "my-code",
+	}); err == nil || !strings.Contains(err.Error(), "a state is required to login with a code") {
+		t.Errorf("expected login without state to fail, got: %v", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		googleAuthCodeParameterName: "my-code",
+		stateParameterName:          stateValue,
+	}); err != nil {
+		t.Errorf("unexpected login error: %s", err)
+	}
+}
+
+// tests CLI logins with a loopback redirect URI
+func TestBackend_LoginLoopbackRedirect(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+	redirectURI := "http://127.0.0.1:8250/oauth2/callback"
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	for _, invalid := range []string{
+		"https://127.0.0.1:8250/",
+		"http://127.0.0.1/",
+		"http://127.0.0.1:0/",
+		"http://10.0.0.1:8250/",
+		"http://localhost.evil.com:8250/",
+		"http://evil.com@127.0.0.1:8250/",
+		"http://127.0.0.1:8250/?next=https://evil.com",
+		"urn:ietf:wg:oauth:2.0:oob",
+	} {
+		if _, err := testHandleRequest(t, b, s, logical.ReadOperation, cliCodeURLPath, map[string]interface{}{
+			redirectURIParameterName: invalid,
+		}); err == nil || !strings.Contains(err.Error(), "redirect_uri") {
+			t.Errorf("expected redirect_uri %s to be rejected, got: %v", invalid, err)
+		}
+	}
+
+	codeURL := func() string {
+		resp, err := testHandleRequest(t, b, s, logical.ReadOperation, cliCodeURLPath, map[string]interface{}{
+			redirectURIParameterName: redirectURI,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error getting code url: %s", err)
+		}
+		u, err := url.Parse(resp.Data[codeURLResponsePropertyName].(string))
+		if err != nil {
+			t.Fatalf("failed to parse url: %s", err)
+		}
+		if exp, act := redirectURI, u.Query().Get("redirect_uri"); exp != act {
+			t.Errorf("unexpected redirect uri in url: exp=%s act=%s", exp, act)
+		}
+		return resp.Data[stateParameterName].(string)
+	}
+
+	login := func(d map[string]interface{}) error {
+		d[googleAuthCodeParameterName] = "my-code"
+		_, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, d)
+		return err
+	}
+
+	matcher := &oauth2ConfigClientIDMatcher{t: t, clientID: "cli-id", redirectURL: redirectURI}
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), "my-code", matcher, gomock.Any()).Times(1).Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).Times(1).Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return([]*admin.Group{}, nil)
+
+	if err := login(map[string]interface{}{
+		redirectURIParameterName: redirectURI,
+	}); err == nil || !strings.Contains(err.Error(), "a state is required to login with a redirect_uri") {
+		t.Errorf("expected login without state to fail, got: %v", err)
+	}
+
+	if err := login(map[string]interface{}{
+		stateParameterName: codeURL(),
+	}); err == nil || !strings.Contains(err.Error(), "redirect_uri doesn't match") {
+		t.Errorf("expected login without redirect_uri to fail, got: %v", err)
+	}
+
+	if err := login(map[string]interface{}{
+		stateParameterName:       codeURL(),
+		redirectURIParameterName: "http://127.0.0.1:8251/oauth2/callback",
+	}); err == nil || !strings.Contains(err.Error(), "redirect_uri doesn't match") {
+		t.Errorf("expected login with other redirect_uri to fail, got: %v", err)
+	}
+
+	if err := login(map[string]interface{}{
+		stateParameterName:       codeURL(),
+		redirectURIParameterName: redirectURI,
+	}); err != nil {
+		t.Errorf("unexpected login error: %s", err)
+	}
+}
+
+// tests that the web redirect URL is derived from the mount point
+func TestBackend_WebRedirectMount(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+
+	handle := func(op logical.Operation, path string, d map[string]interface{}) (*logical.Response, error) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:  op,
+			Path:       path,
+			Data:       d,
+			Storage:    s,
+			MountPoint: "auth/team/google-b/",
+		})
+		if err == nil && resp != nil && resp.IsError() {
+			err = resp.Error()
+		}
+		return resp, err
+	}
+
+	codeURL := func(expRedirectURL string) string {
+		resp, err := handle(logical.ReadOperation, webCodeURLPath, nil)
+		if err != nil {
+			t.Fatalf("unexpected error getting code url: %s", err)
+		}
+		u, err := url.Parse(resp.Data[codeURLResponsePropertyName].(string))
+		if err != nil {
+			t.Fatalf("failed to parse url: %s", err)
+		}
+		if act := u.Query().Get("redirect_uri"); expRedirectURL != act {
+			t.Errorf("unexpected redirect uri in url: exp=%s act=%s", expRedirectURL, act)
+		}
+		return resp.Data[stateParameterName].(string)
+	}
+
+	for _, tc := range []struct {
+		config         map[string]interface{}
+		expRedirectURL string
+	}{
+		{
+			config: map[string]interface{}{
+				webClientIDConfigPropertyName:     "web-id",
+				webClientSecretConfigPropertyName: "web-secret",
+				webRedirectURLConfigPropertyName:  "https://vault.example.com",
+			},
+			expRedirectURL: "https://vault.example.com/ui/vault/auth/google/callback/team/google-b",
+		},
+		{
+			config: map[string]interface{}{
+				webRedirectURLTemplateConfigPropertyName: "https://vault.example.com/custom/{{mount}}/callback",
+			},
+			expRedirectURL: "https://vault.example.com/custom/team/google-b/callback",
+		},
+	} {
+		if _, err := handle(logical.UpdateOperation, configPath, tc.config); err != nil {
+			t.Fatalf("unexpected error writing config: %s", err)
+		}
+
+		stateValue := codeURL(tc.expRedirectURL)
+
+		// the redirect URL of the state is used, even if the config changed in the meantime
+		if _, err := handle(logical.UpdateOperation, configPath, map[string]interface{}{
+			webRedirectURLConfigPropertyName: "https://other.example.com",
+		}); err != nil {
+			t.Fatalf("unexpected error writing config: %s", err)
+		}
+
+		matcher := &oauth2ConfigClientIDMatcher{t: t, clientID: "web-id", redirectURL: tc.expRedirectURL}
+		userMock.EXPECT().oauth2Exchange(gomock.Any(), "my-code", matcher, gomock.Any()).Times(1).Return(token, nil)
+		userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).Times(1).Return(user, nil)
+		groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return([]*admin.Group{}, nil)
+
+		if _, err := handle(logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: "my-code",
+			stateParameterName:          stateValue,
+		}); err != nil {
+			t.Errorf("unexpected login error: %s", err)
+		}
+	}
+}
+
+// tests that group lookups are cached and de-duplicated
+func TestBackend_GroupsCache(t *testing.T) {
+	ctrl, _, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	groupA := &admin.Group{Email: "group-a@a.com"}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		groupsCacheTTLConfigPropertyName:         "1h",
+		groupsCacheNegativeTTLConfigPropertyName: "1h",
+		groupsCacheStorageConfigPropertyName:     true,
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	c, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent lookups result in a single request
+	release := make(chan struct{})
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("a@a.com")).Times(1).DoAndReturn(
+		func(_ context.Context, _ *config, _ string) ([]*admin.Group, error) {
+			<-release
+			return []*admin.Group{groupA}, nil
+		},
+	)
+	errCh := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			groups, err := b.lookupGroups(ctx, s, c, "a@a.com")
+			if err == nil && (len(groups) != 1 || groups[0] != groupA) {
+				err = fmt.Errorf("unexpected groups: %v", groups)
+			}
+			errCh <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// a canceled login doesn't fail the concurrent ones sharing its lookup
+	release = make(chan struct{})
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("c@a.com")).Times(1).DoAndReturn(
+		func(ctx context.Context, _ *config, _ string) ([]*admin.Group, error) {
+			<-release
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return []*admin.Group{groupA}, nil
+		},
+	)
+	canceledCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		_, err := b.lookupGroups(canceledCtx, s, c, "c@a.com")
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		_, err := b.lookupGroups(ctx, s, c, "c@a.com")
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("expected the canceled login to fail, got: %v", err)
+	}
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error of the concurrent login: %s", err)
+	}
+
+	// timed out lookups aren't cached as failed
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("d@a.com")).Times(2).Return(nil, &url.Error{Op: "Get", URL: "https://www.googleapis.com", Err: context.DeadlineExceeded})
+	for i := 0; i < 2; i++ {
+		if _, err := b.lookupGroups(ctx, s, c, "d@a.com"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected timeout error, got %v", err)
+		}
+	}
+
+	// cached lookups use a lower case key
+	if groups, err := b.lookupGroups(ctx, s, c, "A@a.com"); err != nil || len(groups) != 1 {
+		t.Errorf("expected cached groups, got %v, %v", groups, err)
+	}
+
+	// failed lookups are cached as well
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("b@a.com")).Times(1).Return(nil, fmt.Errorf("quota exceeded"))
+	for i := 0; i < 2; i++ {
+		if _, err := b.lookupGroups(ctx, s, c, "b@a.com"); err == nil || err.Error() != "quota exceeded" {
+			t.Errorf("expected cached error, got %v", err)
+		}
+	}
+
+	// cached groups are read from storage after a restart
+	b.groupsCache.flush()
+	if groups, err := b.lookupGroups(ctx, s, c, "a@a.com"); err != nil || len(groups) != 1 || groups[0].Email != groupA.Email {
+		t.Errorf("expected groups from storage, got %v, %v", groups, err)
+	}
+
+	// expired items are looked up again
+	c.GroupsCacheTTL = time.Nanosecond
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("a@a.com")).Times(1).Return([]*admin.Group{}, nil)
+	if groups, err := b.lookupGroups(ctx, s, c, "a@a.com"); err != nil || len(groups) != 0 {
+		t.Errorf("expected no groups after expiry, got %v, %v", groups, err)
+	}
+
+	// config changes purge the cache
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		groupsCacheNegativeTTLConfigPropertyName: "1m",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	if keys, err := s.List(ctx, groupsCacheEntry); err != nil || len(keys) != 0 {
+		t.Errorf("expected no cached groups in storage, got %v, %v", keys, err)
+	}
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("b@a.com")).Times(1).Return([]*admin.Group{groupA}, nil)
+	if groups, err := b.lookupGroups(ctx, s, c, "b@a.com"); err != nil || len(groups) != 1 {
+		t.Errorf("expected groups after purge, got %v, %v", groups, err)
+	}
+}
+
+// tests that nested groups are resolved with cycles and a depth limit
+func TestBackend_GroupsTransitive(t *testing.T) {
+	ctrl, _, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	// user -> a -> b -> c -> a (cycle), user -> b
+	groupA := &admin.Group{Email: "a@a.com"}
+	groupB := &admin.Group{Email: "b@a.com"}
+	groupC := &admin.Group{Email: "c@a.com"}
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("user@a.com")).AnyTimes().Return([]*admin.Group{groupA, groupB}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(groupA.Email)).AnyTimes().Return([]*admin.Group{groupB}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(groupB.Email)).AnyTimes().Return([]*admin.Group{groupC}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(groupC.Email)).AnyTimes().Return([]*admin.Group{groupA}, nil)
+
+	for _, tc := range []struct {
+		config   *config
+		expected []string
+	}{
+		{&config{}, []string{"a@a.com", "b@a.com"}},
+		{&config{GroupsTransitive: true}, []string{"a@a.com", "b@a.com", "c@a.com"}},
+		{&config{GroupsTransitive: true, GroupsMaxDepth: 1}, []string{"a@a.com", "b@a.com"}},
+	} {
+		groups, err := b.fetchGroups(ctx, tc.config, "user@a.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if emails := groupEmails(groups); !reflect.DeepEqual(emails, tc.expected) {
+			t.Errorf("unexpected groups for %+v: %v, expected %v", tc.config, emails, tc.expected)
+		}
+	}
+
+	// errors looking up parents fail the lookup
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("other@a.com")).Times(1).Return([]*admin.Group{{Email: "d@a.com"}}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("d@a.com")).Times(1).Return(nil, fmt.Errorf("not found"))
+	if _, err := b.fetchGroups(ctx, &config{GroupsTransitive: true}, "other@a.com"); err == nil {
+		t.Error("expected error looking up parent groups")
+	}
+}
+
+// tests the handling of failed group lookups during login and renewal
+func TestBackend_GroupsLookupFailure(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+	groupA := &admin.Group{Email: "group-a@a.com"}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(user.Email), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).AnyTimes().Return(user, nil)
+
+	writeConfig := func(mode string) {
+		if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+			cliClientIDConfigPropertyName:             "cli-id",
+			cliClientSecretConfigPropertyName:         "cli-secret",
+			groupsLookupFailureModeConfigPropertyName: mode,
+		}); err != nil {
+			t.Fatalf("unexpected error writing config: %s", err)
+		}
+	}
+	login := func() (*logical.Response, error) {
+		return testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: user.Email,
+		})
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		groupsLookupFailureModeConfigPropertyName: "maybe",
+	}); err == nil || !strings.Contains(err.Error(), "groups_lookup_failure_mode must be one of") {
+		t.Errorf("expected invalid failure mode to be rejected, got: %v", err)
+	}
+
+	// allow continues without groups
+	writeConfig(groupsLookupFailureModeAllow)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(nil, fmt.Errorf("backend error"))
+	if resp, err := login(); err != nil {
+		t.Errorf("unexpected login error: %s", err)
+	} else if len(resp.Auth.GroupAliases) != 1 {
+		t.Errorf("expected only the domain group alias, got %v", resp.Auth.GroupAliases)
+	}
+
+	// deny rejects the login
+	writeConfig(groupsLookupFailureModeDeny)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(nil, fmt.Errorf("backend error"))
+	if _, err := login(); err == nil || !strings.Contains(err.Error(), "unable to look up the groups of the user") {
+		t.Errorf("expected login to be denied, got: %v", err)
+	}
+
+	// cached uses the groups of the last successful lookup
+	writeConfig(groupsLookupFailureModeCached)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(nil, fmt.Errorf("backend error"))
+	if _, err := login(); err == nil {
+		t.Error("expected login to be denied without known groups")
+	}
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return([]*admin.Group{groupA}, nil)
+	resp, err := login()
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(nil, fmt.Errorf("backend error"))
+	if resp, err := testRenew(t, b, s, resp.Auth); err != nil {
+		t.Errorf("unexpected renew error: %s", err)
+	} else if len(resp.Auth.GroupAliases) != 2 || resp.Auth.GroupAliases[0].Name != groupA.Email {
+		t.Errorf("expected the cached group alias, got %v", resp.Auth.GroupAliases)
+	}
+}
+
+// tests that the directory account of the user is validated on login and
+// renewal
+func TestBackend_ValidateAccount(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	accountMock := NewMockAccountProvider(ctrl)
+	b.account = accountMock
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(user.Email), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).AnyTimes().Return([]*admin.Group{}, nil)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:           "cli-id",
+		cliClientSecretConfigPropertyName:       "cli-secret",
+		validateAccountStatusConfigPropertyName: true,
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	login := func() (*logical.Response, error) {
+		return testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: user.Email,
+		})
+	}
+
+	// the directory needs to be configured
+	if _, err := login(); err == nil || !strings.Contains(err.Error(), "requires directory_impersonate_user") {
+		t.Errorf("expected login to fail without directory config, got: %v", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		directoryServiceAccountKeyConfigPropertyName: testServiceAccountKey(t, "http://127.0.0.1/token"),
+		directoryImpersonateUserConfigPropertyName:   "admin@a.com",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(&admin.User{PrimaryEmail: user.Email}, nil)
+	resp, err := login()
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+
+	for _, tc := range []struct {
+		account  *admin.User
+		err      error
+		config   map[string]interface{}
+		expected string
+	}{
+		{
+			account:  &admin.User{Suspended: true},
+			expected: "account of the user is suspended",
+		},
+		{
+			account:  &admin.User{Archived: true},
+			expected: "account of the user is archived",
+		},
+		{
+			err:      &googleapi.Error{Code: http.StatusNotFound},
+			expected: "account of the user no longer exists",
+		},
+		{
+			err:      &googleapi.Error{Code: http.StatusForbidden},
+			expected: "unable to look up the account of the user",
+		},
+		{
+			account:  &admin.User{},
+			config:   map[string]interface{}{require2SVConfigPropertyName: true},
+			expected: "user is not enrolled in 2-step verification",
+		},
+		{
+			account: &admin.User{IsEnrolledIn2Sv: true},
+		},
+	} {
+		if tc.config != nil {
+			if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, tc.config); err != nil {
+				t.Fatalf("unexpected error writing config: %s", err)
+			}
+		}
+		accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(tc.account, tc.err)
+		_, err := testRenew(t, b, s, resp.Auth)
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected renew error: %s", err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected renew error %q, got: %v", tc.expected, err)
+		}
+	}
+}
+
+// tests that allowed_org_units restricts logins and renewals to users of the
+// org units and their sub units
+func TestBackend_AllowedOrgUnits(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	accountMock := NewMockAccountProvider(ctrl)
+	b.account = accountMock
+
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: user.Email}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Eq(user.Email), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Eq(token)).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).AnyTimes().Return([]*admin.Group{}, nil)
+
+	// org unit paths need to be absolute
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		allowedOrgUnitsConfigPropertyName: "Engineering",
+	}); err == nil || !strings.Contains(err.Error(), "invalid org unit path") {
+		t.Errorf("expected invalid org unit path error, got: %v", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:                "cli-id",
+		cliClientSecretConfigPropertyName:            "cli-secret",
+		directoryServiceAccountKeyConfigPropertyName: testServiceAccountKey(t, "http://127.0.0.1/token"),
+		directoryImpersonateUserConfigPropertyName:   "admin@a.com",
+		allowedOrgUnitsConfigPropertyName:            "/Engineering/SRE,/Sales/",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	login := func() (*logical.Response, error) {
+		return testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: user.Email,
+		})
+	}
+
+	for _, tc := range []struct {
+		orgUnit string
+		allowed bool
+	}{
+		{"/Engineering/SRE", true},
+		{"/engineering/sre/oncall", true},
+		{"/Sales", true},
+		{"/Engineering", false},
+		{"/Engineering/SRE-Interns", false},
+		{"/", false},
+	} {
+		accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(&admin.User{OrgUnitPath: tc.orgUnit}, nil)
+		resp, err := login()
+		if !tc.allowed {
+			if err == nil || !strings.Contains(err.Error(), "user is not allowed to login") {
+				t.Errorf("expected login of org unit %s to be denied, got: %v", tc.orgUnit, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected login error for org unit %s: %s", tc.orgUnit, err)
+			continue
+		}
+		if actual := resp.Auth.Alias.Metadata["org_unit"]; actual != tc.orgUnit {
+			t.Errorf("expected org_unit alias metadata %q, got %q", tc.orgUnit, actual)
+		}
+	}
+
+	// renewals are denied once the user moved out of the org unit
+	accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(&admin.User{OrgUnitPath: "/Sales/EMEA"}, nil)
+	resp, err := login()
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(&admin.User{OrgUnitPath: "/Sales/EMEA"}, nil)
+	if _, err := testRenew(t, b, s, resp.Auth); err != nil {
+		t.Errorf("unexpected renew error: %s", err)
+	}
+	accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(&admin.User{OrgUnitPath: "/Marketing"}, nil)
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil || !strings.Contains(err.Error(), "user is not allowed to login") {
+		t.Errorf("expected renew to be denied, got: %v", err)
+	}
+
+	// the org unit is required in addition to the other allowed lists
+	for _, tc := range []struct {
+		domains string
+		orgUnit string
+		allowed bool
+	}{
+		{"a.com", "/Sales", true},
+		{"a.com", "/Marketing", false},
+		{"b.com", "/Sales", false},
+	} {
+		if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+			allowedDomainsConfigPropertyName: tc.domains,
+		}); err != nil {
+			t.Fatalf("unexpected error writing config: %s", err)
+		}
+		accountMock.EXPECT().lookupUser(gomock.Any(), gomock.Any(), gomock.Eq(user.Email)).Times(1).Return(&admin.User{OrgUnitPath: tc.orgUnit}, nil)
+		_, err := login()
+		if tc.allowed && err != nil {
+			t.Errorf("unexpected login error for domains %s and org unit %s: %s", tc.domains, tc.orgUnit, err)
+		}
+		if !tc.allowed && (err == nil || !strings.Contains(err.Error(), "user is not allowed to login")) {
+			t.Errorf("expected login for domains %s and org unit %s to be denied, got: %v", tc.domains, tc.orgUnit, err)
+		}
+	}
+}
+
+// tests that the Google tokens of expired logins are revoked
+func TestBackend_TokenRevocation(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	revocationRetryDelay = 0
+	defer func() { revocationRetryDelay = time.Second }()
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	req := &logical.Request{Storage: s}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return([]*admin.Group{}, nil)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		cliTTLConfigPropertyName:          "1h",
+		cliMaxTTLConfigPropertyName:       "2h",
+		revocationURLConfigPropertyName:   "http://127.0.0.1:1234/revoke",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	login := func() (string, *logical.Auth) {
+		resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: "code",
+		})
+		if err != nil {
+			t.Fatalf("unexpected login error: %s", err)
+		}
+		grantID, _ := resp.Auth.InternalData["grant"].(string)
+		if grantID == "" {
+			t.Fatal("expected login to track the grant")
+		}
+		return grantID, resp.Auth
+	}
+	expire := func(id string) {
+		g, err := b.grant(ctx, s, id)
+		if err != nil || g == nil {
+			t.Fatalf("expected grant %s, got %v, %v", id, g, err)
+		}
+		g.Expires = time.Now().Add(-time.Second)
+		if err := b.putGrant(ctx, s, id, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grantA, authA := login()
+	grantB, _ := login()
+
+	// renewals extend the expiry up to the max ttl
+	g, _ := b.grant(ctx, s, grantA)
+	if d := g.MaxExpires.Sub(g.Created); d != 2*time.Hour {
+		t.Errorf("unexpected max expiry of grant: %s", d)
+	}
+	g.Expires = time.Now()
+	if err := b.putGrant(ctx, s, grantA, g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testRenew(t, b, s, authA); err != nil {
+		t.Fatalf("unexpected renew error: %s", err)
+	}
+	if g, _ := b.grant(ctx, s, grantA); time.Until(g.Expires) < 59*time.Minute {
+		t.Errorf("expected renewal to extend the grant, expires %s", g.Expires)
+	}
+
+	// unexpired grants are kept
+	if err := b.revokeExpiredGrants(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ids, _ := s.List(ctx, grantEntry); len(ids) != 2 {
+		t.Errorf("expected both grants to be kept, got %v", ids)
+	}
+
+	// the refresh token is revoked, already revoked tokens are fine
+	expire(grantA)
+	expire(grantB)
+	userMock.EXPECT().revokeToken(gomock.Any(), gomock.Eq("http://127.0.0.1:1234/revoke"), gomock.Eq("refresh")).Times(1).Return(nil)
+	userMock.EXPECT().revokeToken(gomock.Any(), gomock.Eq("http://127.0.0.1:1234/revoke"), gomock.Eq("refresh")).Times(1).Return(&oauth2Error{Code: "invalid_token"})
+	if err := b.revokeExpiredGrants(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ids, _ := s.List(ctx, grantEntry); len(ids) != 0 {
+		t.Errorf("expected revoked grants to be removed, got %v", ids)
+	}
+
+	// failed revocations are retried and kept for the next sweep
+	grantC, _ := login()
+	expire(grantC)
+	userMock.EXPECT().revokeToken(gomock.Any(), gomock.Any(), gomock.Any()).Times(revocationAttempts).Return(fmt.Errorf("unavailable"))
+	if err := b.revokeExpiredGrants(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g, _ := b.grant(ctx, s, grantC); g == nil || g.Attempts != 1 {
+		t.Errorf("expected grant to be kept with one failed attempt, got %+v", g)
+	}
+
+	// disabling revocation stops tracking and drops expired grants
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		disableTokenRevocationConfigPropertyName: true,
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	if err := b.revokeExpiredGrants(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		googleAuthCodeParameterName: "code",
+	})
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	if _, ok := resp.Auth.InternalData["grant"]; ok {
+		t.Error("expected no grant to be tracked")
+	}
+	if ids, _ := s.List(ctx, grantEntry); len(ids) != 0 {
+		t.Errorf("expected no grants, got %v", ids)
+	}
+}
+
+// tests that every login revokes its own token once it expired, as Google
+// issues a refresh token per grant, and that grants are never dropped before
+// their token is revoked
+func TestBackend_TokenRevocationOverlappingLogins(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	revocationRetryDelay = 0
+	defer func() { revocationRetryDelay = time.Second }()
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	req := &logical.Request{Storage: s}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+
+	gomock.InOrder(
+		userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).Return(&oauth2.Token{AccessToken: "access-a", RefreshToken: "refresh-a"}, nil),
+		userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).Return(&oauth2.Token{AccessToken: "access-b", RefreshToken: "refresh-b"}, nil),
+	)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return([]*admin.Group{}, nil)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		cliTTLConfigPropertyName:          "1h",
+		revocationURLConfigPropertyName:   "http://127.0.0.1:1234/revoke",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	login := func() (string, *logical.Auth) {
+		resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: "code",
+		})
+		if err != nil {
+			t.Fatalf("unexpected login error: %s", err)
+		}
+		return resp.Auth.InternalData["grant"].(string), resp.Auth
+	}
+	expire := func(id string) {
+		g, err := b.grant(ctx, s, id)
+		if err != nil || g == nil {
+			t.Fatalf("expected grant %s, got %v, %v", id, g, err)
+		}
+		g.Expires = time.Now().Add(-time.Second)
+		if err := b.putGrant(ctx, s, id, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grantA, _ := login()
+	grantB, authB := login()
+
+	// only the token of the expired login is revoked
+	expire(grantA)
+	userMock.EXPECT().revokeToken(gomock.Any(), gomock.Any(), gomock.Eq("refresh-a")).Times(1).Return(nil)
+	if err := b.revokeExpiredGrants(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ids, _ := s.List(ctx, grantEntry); !reflect.DeepEqual(ids, []string{grantB}) {
+		t.Errorf("expected only the live grant to be kept, got %v", ids)
+	}
+	if _, err := testRenew(t, b, s, authB); err != nil {
+		t.Errorf("unexpected renew error: %s", err)
+	}
+
+	// a token that can't be revoked keeps its grant, however often it failed
+	expire(grantB)
+	userMock.EXPECT().revokeToken(gomock.Any(), gomock.Any(), gomock.Eq("refresh-b")).Times(revocationAttempts * (revocationMaxSweeps + 1)).Return(fmt.Errorf("unavailable"))
+	for i := 0; i <= revocationMaxSweeps; i++ {
+		if err := b.revokeExpiredGrants(ctx, req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if g, _ := b.grant(ctx, s, grantB); g == nil || g.Attempts != revocationMaxSweeps+1 {
+		t.Errorf("expected unrevoked grant to be kept, got %+v", g)
+	}
+
+	// the grant is removed once the token is revoked
+	userMock.EXPECT().revokeToken(gomock.Any(), gomock.Any(), gomock.Eq("refresh-b")).Times(1).Return(nil)
+	if err := b.revokeExpiredGrants(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ids, _ := s.List(ctx, grantEntry); len(ids) != 0 {
+		t.Errorf("expected revoked grants to be removed, got %v", ids)
+	}
+}
+
+// tests that tokens are encrypted with a rotatable keyring
+func TestBackend_TokenEncryption(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	user := &goauth.Userinfoplus{
+		Email: "a@a.com",
+		Hd:    "a.com",
+	}
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+
+	userMock.EXPECT().oauth2Exchange(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(token, nil)
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(user, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return([]*admin.Group{}, nil)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	login := func() *logical.Auth {
+		resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: "code",
+		})
+		if err != nil {
+			t.Fatalf("unexpected login error: %s", err)
+		}
+		return resp.Auth
+	}
+
+	authA := login()
+	encrypted := authA.InternalData["token"].(string)
+	if !strings.HasPrefix(encrypted, tokenEnvelopePrefix+"1:") || strings.Contains(encrypted, "refresh") {
+		t.Errorf("expected token encrypted with key version 1, got %s", encrypted)
+	}
+
+	// rotation keeps old keys for existing logins
+	resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, keyringRotatePath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error rotating keyring: %s", err)
+	}
+	if v := resp.Data[keyVersionResponsePropertyName]; v != 2 {
+		t.Errorf("expected key version 2, got %v", v)
+	}
+	authB := login()
+	if encrypted := authB.InternalData["token"].(string); !strings.HasPrefix(encrypted, tokenEnvelopePrefix+"2:") {
+		t.Errorf("expected token encrypted with key version 2, got %s", encrypted)
+	}
+
+	// the keyring is read from storage
+	b.invalidate(ctx, keyringEntry)
+	for _, auth := range []*logical.Auth{authA, authB} {
+		if _, err := testRenew(t, b, s, auth); err != nil {
+			t.Errorf("unexpected renew error: %s", err)
+		}
+	}
+
+	// tokens of logins before encryption are still supported
+	legacy, err := encodeToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := b.decryptToken(ctx, s, legacy); err != nil || decrypted.RefreshToken != token.RefreshToken {
+		t.Errorf("expected legacy token to be decoded, got %v, %v", decrypted, err)
+	}
+
+	// tampered tokens are rejected
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+	if _, err := b.decryptToken(ctx, s, tampered); err == nil {
+		t.Error("expected tampered token to be rejected")
+	}
+	if _, err := b.decryptToken(ctx, s, tokenEnvelopePrefix+"3:"+strings.Split(encrypted, ":")[3]); err == nil || !strings.Contains(err.Error(), "key version 3") {
+		t.Errorf("expected unknown key version to be rejected, got %v", err)
+	}
+}
+
+// tests the login of service accounts with Google-signed and self-signed JWTs
+func TestBackend_LoginServiceAccount(t *testing.T) {
+	ctrl, _, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	googleSigner := newTestJWTSigner(t, "google-1")
+	saSigner := newTestJWTSigner(t, "sa-1")
+	googleServer := newTestJWKSServer(t, map[string]*testJWTSigner{"google-1": googleSigner})
+	defer googleServer.Close()
+	saServer := newTestJWKSServer(t, map[string]*testJWTSigner{"sa-1": saSigner})
+	defer saServer.Close()
+
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return([]*admin.Group{}, nil)
+
+	const (
+		computeSA = "123-compute@developer.gserviceaccount.com"
+		appSA     = "app@my-project.iam.gserviceaccount.com"
+	)
+
+	for _, step := range []struct {
+		path string
+		data map[string]interface{}
+	}{
+		{configPath, map[string]interface{}{
+			jwksURLConfigPropertyName:               googleServer.URL,
+			serviceAccountJWKSURLConfigPropertyName: saServer.URL + "/" + emailPlaceholder,
+			jwtAudiencesConfigPropertyName:          "vault",
+		}},
+		{rolePath + "gce", map[string]interface{}{
+			boundProjectsRolePropertyName: "my-project",
+			boundZonesRolePropertyName:    "europe-west1-b",
+			policiesRolePropertyName:      "gce",
+		}},
+		{rolePath + "app", map[string]interface{}{
+			boundServiceAccountsRolePropertyName: appSA,
+			policiesRolePropertyName:             "app",
+		}},
+	} {
+		if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, step.path, step.data); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", step.path, err)
+		}
+	}
+
+	now := time.Now()
+	googleToken := func(email, zone string) string {
+		return googleSigner.sign(&jwt.Claims{
+			Issuer:   "https://accounts.google.com",
+			Subject:  "1234",
+			Audience: jwt.Audience{"vault"},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		}, map[string]interface{}{
+			"email":          email,
+			"email_verified": true,
+			"google": map[string]interface{}{
+				"compute_engine": map[string]interface{}{
+					"project_id":    "my-project",
+					"zone":          zone,
+					"instance_name": "vm-1",
+				},
+			},
+		})
+	}
+	selfSignedToken := func(signer *testJWTSigner, email string, lifetime time.Duration) string {
+		return signer.sign(&jwt.Claims{
+			Issuer:   email,
+			Subject:  email,
+			Audience: jwt.Audience{"vault"},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(lifetime)),
+		})
+	}
+	humanToken := googleSigner.sign(&jwt.Claims{
+		Issuer:   "https://accounts.google.com",
+		Subject:  "5678",
+		Audience: jwt.Audience{"vault"},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}, map[string]interface{}{
+		"email":          "a@a.com",
+		"email_verified": true,
+		"hd":             "a.com",
+	})
+
+	login := func(role, token string) (*logical.Response, error) {
+		return testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			jwtParameterName:  token,
+			roleParameterName: role,
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		role     string
+		token    string
+		expErr   string
+		expEmail string
+	}{
+		{
+			name:     "compute engine",
+			role:     "gce",
+			token:    googleToken(computeSA, "europe-west1-b"),
+			expEmail: computeSA,
+		},
+		{
+			name:   "compute engine in other zone",
+			role:   "gce",
+			token:  googleToken(computeSA, "us-east1-b"),
+			expErr: "service account is not allowed to login with role \"gce\"",
+		},
+		{
+			name:   "no role",
+			token:  googleToken(computeSA, "europe-west1-b"),
+			expErr: "a role is required to login with a service account",
+		},
+		{
+			name:     "self-signed",
+			role:     "app",
+			token:    selfSignedToken(saSigner, appSA, 10*time.Minute),
+			expEmail: appSA,
+		},
+		{
+			name:   "self-signed by other service account",
+			role:   "app",
+			token:  selfSignedToken(saSigner, "other@my-project.iam.gserviceaccount.com", 10*time.Minute),
+			expErr: "service account is not allowed to login with role \"app\"",
+		},
+		{
+			name:   "self-signed with wrong key",
+			role:   "app",
+			token:  selfSignedToken(googleSigner, appSA, 10*time.Minute),
+			expErr: "no key found for key id",
+		},
+		{
+			name:   "self-signed valid for too long",
+			role:   "app",
+			token:  selfSignedToken(saSigner, appSA, 20*time.Minute),
+			expErr: "self-signed JWT must not be valid for more than",
+		},
+		{
+			name:   "user with service account role",
+			role:   "app",
+			token:  humanToken,
+			expErr: "user is not allowed to login with role \"app\"",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := login(tc.role, tc.token)
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Errorf("expected error %q, got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected login error: %s", err)
+			}
+			if resp.Auth.Alias.Name != tc.expEmail {
+				t.Errorf("unexpected alias %s, expected %s", resp.Auth.Alias.Name, tc.expEmail)
+			}
+			if !policyutil.EquivalentPolicies(resp.Auth.Policies, []string{tc.role}) {
+				t.Errorf("unexpected policies %v", resp.Auth.Policies)
+			}
+		})
+	}
+
+	// self-signed JWTs require explicitly configured audiences
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "vault",
+		cliClientSecretConfigPropertyName: "secret",
+		jwtAudiencesConfigPropertyName:    "",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	if _, err := login("app", selfSignedToken(saSigner, appSA, 10*time.Minute)); err == nil || !strings.Contains(err.Error(), "jwt_audiences must be configured") {
+		t.Errorf("expected self-signed JWT without jwt_audiences to be rejected, got: %v", err)
+	}
+
+	// renewals re-check the role bindings
+	resp, err := login("gce", googleToken(computeSA, "europe-west1-b"))
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	if zone := resp.Auth.Metadata["zone"]; zone != "europe-west1-b" {
+		t.Errorf("unexpected zone metadata: %s", zone)
+	}
+	if _, err := testRenew(t, b, s, resp.Auth); err != nil {
+		t.Errorf("unexpected renew error: %s", err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, rolePath+"gce", map[string]interface{}{
+		boundZonesRolePropertyName: "us-east1-b",
+	}); err != nil {
+		t.Fatalf("unexpected error writing role: %s", err)
+	}
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil || !strings.Contains(err.Error(), "service account is not allowed") {
+		t.Errorf("expected renew to fail, got: %v", err)
+	}
+}
+
+// returns the JSON key of a service account, which gets its tokens from the
+// token URL
+func testServiceAccountKey(t *testing.T, tokenURL string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	keyJSON, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "groups@my-project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(keyJSON)
+}
+
+// tests group lookups with the Cloud Identity Groups API
+func TestBackend_GroupsCloudIdentity(t *testing.T) {
+	ctrl, _, _, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"access_token":"groups-token","token_type":"Bearer","expires_in":3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer groups-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query().Get("query")
+		if q == `member_key_id == 'o\'brien\\@a.com' && 'cloudidentity.googleapis.com/groups.discussion_forum' in labels` {
+			fmt.Fprint(w, `{"memberships":[{"group":"groups/4","groupKey":{"id":"group-o@a.com"}}]}`)
+			return
+		}
+		if q != "member_key_id == 'a@a.com' && 'cloudidentity.googleapis.com/groups.discussion_forum' in labels" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":{"message":"unexpected query %s"}}`, q)
+			return
+		}
+		switch r.URL.Path {
+		case "/groups/-/memberships:searchDirectGroups":
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprint(w, `{"memberships":[{"group":"groups/1","groupKey":{"id":"group-a@a.com"},"displayName":"Group A"}],"nextPageToken":"page-2"}`)
+				return
+			}
+			fmt.Fprint(w, `{"memberships":[{"group":"groups/2","groupKey":{"id":"group-b@a.com"},"displayName":"Group B"}]}`)
+		case "/groups/-/memberships:searchTransitiveGroups":
+			fmt.Fprint(w, `{"memberships":[{"group":"groups/1","groupKey":{"id":"group-a@a.com"}},{"group":"groups/3","groupKey":{"id":"parent@a.com"}}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		groupsProviderConfigPropertyName: "ldap",
+	}); err == nil || !strings.Contains(err.Error(), "groups_provider must be one of") {
+		t.Errorf("expected invalid groups provider to be rejected, got: %v", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		groupsProviderConfigPropertyName:             groupsProviderCloudIdentity,
+		directoryServiceAccountKeyConfigPropertyName: testServiceAccountKey(t, server.URL+"/token"),
+		cloudIdentityURLConfigPropertyName:           server.URL,
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	c, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := b.fetchGroups(ctx, c, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if emails := groupEmails(groups); !reflect.DeepEqual(emails, []string{"group-a@a.com", "group-b@a.com"}) {
+		t.Errorf("unexpected direct groups: %v", emails)
+	}
+	if groups[0].Name != "Group A" {
+		t.Errorf("unexpected group name: %s", groups[0].Name)
+	}
+
+	c.GroupsTransitive = true
+	groups, err = b.fetchGroups(ctx, c, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if emails := groupEmails(groups); !reflect.DeepEqual(emails, []string{"group-a@a.com", "parent@a.com"}) {
+		t.Errorf("unexpected transitive groups: %v", emails)
+	}
+
+	if _, err := b.fetchGroups(ctx, c, "b@a.com"); err == nil || !strings.Contains(err.Error(), "unexpected query") {
+		t.Errorf("expected error from Cloud Identity, got: %v", err)
+	}
+
+	// quotes and backslashes are escaped in the query
+	groups, err = b.fetchGroups(ctx, c, `o'brien\@a.com`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if emails := groupEmails(groups); !reflect.DeepEqual(emails, []string{"group-o@a.com"}) {
+		t.Errorf("unexpected groups: %v", emails)
+	}
+
+	// group lookups can be disabled
+	c.GroupsProvider = groupsProviderNone
+	if groups, err := b.fetchGroups(ctx, c, "a@a.com"); err != nil || len(groups) != 0 {
+		t.Errorf("expected no groups, got %v, %v", groups, err)
+	}
+}
+
+// tests keyless credentials signed by the IAM Credentials API
+func TestBackend_CredentialsSignJWT(t *testing.T) {
+	ctrl, _, _, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	const delegated = "delegated@my-project.iam.gserviceaccount.com"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != jwtBearerGrantType {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// tokens of the application default credentials and of the
+			// delegated service account
+			token := "adc-token"
+			if r.PostForm.Get("assertion") == "signed-jwt" {
+				token = "delegated-token"
+			}
+			fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":3600}`, token)
+		case "/v1/projects/-/serviceAccounts/" + delegated + ":signJwt":
+			var req struct {
+				Payload string `json:"payload"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("unable to decode signJwt request: %s", err)
+			}
+			var claims map[string]interface{}
+			if err := json.Unmarshal([]byte(req.Payload), &claims); err != nil {
+				t.Errorf("unable to decode signJwt payload: %s", err)
+			}
+			if r.Header.Get("Authorization") != "Bearer adc-token" || claims["iss"] != delegated || claims["sub"] != "admin@a.com" || claims["scope"] != "scope-a scope-b" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"keyId":"1","signedJwt":"signed-jwt"}`)
+		case "/api":
+			if r.Header.Get("Authorization") != "Bearer delegated-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// application default credentials
+	adcFile, err := ioutil.TempFile("", "adc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(adcFile.Name())
+	if _, err := adcFile.WriteString(testServiceAccountKey(t, server.URL+"/token")); err != nil {
+		t.Fatal(err)
+	}
+	adcFile.Close()
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", adcFile.Name())
+
+	expectSource := func(source string) {
+		resp, err := testHandleRequest(t, b, s, logical.ReadOperation, configPath, nil)
+		if err != nil {
+			t.Fatalf("unexpected error reading config: %s", err)
+		}
+		if v := resp.Data[directoryCredentialSourceResponsePropertyName]; v != source {
+			t.Errorf("expected credential source %s, got %v", source, v)
+		}
+	}
+
+	expectSource(credentialSourceNone)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		directoryServiceAccountEmailConfigPropertyName: delegated,
+		directoryImpersonateUserConfigPropertyName:     "admin@a.com",
+		iamCredentialsURLConfigPropertyName:            server.URL,
+		tokenURLConfigPropertyName:                     server.URL + "/token",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	expectSource(credentialSourceSignJWT)
+
+	c, err := b.config(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tokens are fetched with the HTTP client of the context
+	var lock sync.Mutex
+	var paths []string
+	pluginClient := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), oauth2.HTTPClient, pluginClient))
+	client, err := credentialsClient(ctx, c, c.DirectoryImpersonateUser, "scope-a", "scope-b")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the client outlives the request it was created for
+	cancel()
+	resp, err := client.Get(server.URL + "/api")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected request with the delegated token, got status %d", resp.StatusCode)
+	}
+	lock.Lock()
+	if exp := []string{"/token", "/v1/projects/-/serviceAccounts/" + delegated + ":signJwt", "/token", "/api"}; !reflect.DeepEqual(exp, paths) {
+		t.Errorf("expected requests with the HTTP client of the context, exp=%v act=%v", exp, paths)
+	}
+	lock.Unlock()
+
+	// a key takes precedence
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		directoryServiceAccountKeyConfigPropertyName: testServiceAccountKey(t, server.URL+"/token"),
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	expectSource(credentialSourceServiceAccountKey)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// tests that config writes are validated as a whole
+func TestBackend_ConfigValidation(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	s := &logical.InmemStorage{}
+
+	_, err = testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:                "cli-id",
+		cliTTLConfigPropertyName:                     "2h",
+		cliMaxTTLConfigPropertyName:                  "1h",
+		webMaxTTLConfigPropertyName:                  "1000h",
+		webRedirectURLConfigPropertyName:             "vault.example.com",
+		jwksURLConfigPropertyName:                    "ftp://example.com/keys",
+		groupsMaxDepthConfigPropertyName:             -1,
+		directoryServiceAccountKeyConfigPropertyName: "not-json",
+		directoryImpersonateUserConfigPropertyName:   "admin",
+		allowedUsersConfigPropertyName:               "a@a.com,not-an-email",
+		allowedDomainsConfigPropertyName:             "a.com,-invalid-.com",
+		groupsProviderConfigPropertyName:             "ldap",
+		allowedGroupsConfigPropertyName:              "re:(unclosed",
+	})
+	if err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	for _, expected := range []string{
+		"cli_client_id and cli_client_secret must be set together",
+		"cli_ttl must not be greater than cli_max_ttl",
+		"web_max_ttl must not be greater than the mount's max TTL",
+		"web_redirect_url must use the http or https scheme",
+		"jwks_url must use the http or https scheme",
+		"groups_max_depth must not be negative",
+		"directory_service_account_key is not a valid service account key",
+		"directory_impersonate_user contains an invalid email address: \"admin\"",
+		"allowed_users contains an invalid email address: \"not-an-email\"",
+		"allowed_domains contains an invalid domain: \"-invalid-.com\"",
+		"groups_provider must be one of",
+		"allowed_groups contains an invalid pattern \"re:(unclosed\"",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q, got: %s", expected, err)
+		}
+	}
+
+	// nothing is stored
+	if entry, err := s.Get(context.Background(), configEntry); err != nil || entry != nil {
+		t.Errorf("expected no config to be stored, got %v, %v", entry, err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		cliTTLConfigPropertyName:          "1h",
+		cliMaxTTLConfigPropertyName:       "2h",
+		webRedirectURLConfigPropertyName:  "https://vault.example.com",
+		allowedUsersConfigPropertyName:    "a@a.com",
+		allowedDomainsConfigPropertyName:  "a.com,sub.b.co.uk,glob:*.c.com",
+		allowedGroupsConfigPropertyName:   "glob:team-*@a.com",
+	}); err != nil {
+		t.Errorf("unexpected error writing valid config: %s", err)
+	}
+}
+
+// tests that fields can be removed and the config can be deleted
+func TestBackend_ConfigDelete(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:     "cli-id",
+		cliClientSecretConfigPropertyName: "cli-secret",
+		allowedGroupsConfigPropertyName:   "group-a@a.com",
+		allowedDomainsConfigPropertyName:  "a.com",
+		groupsCacheTTLConfigPropertyName:  "1h",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	// fields can't be set and removed at once
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		allowedGroupsConfigPropertyName: "group-b@a.com",
+		removeFieldsParameterName:       allowedGroupsConfigPropertyName,
+	}); err == nil || !strings.Contains(err.Error(), "can't be set and removed") {
+		t.Errorf("expected error setting and removing a field, got %v", err)
+	}
+
+	// unknown fields are rejected
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		removeFieldsParameterName: "allowed_gropus",
+	}); err == nil || !strings.Contains(err.Error(), "unknown field 'allowed_gropus'") {
+		t.Errorf("expected error removing an unknown field, got %v", err)
+	}
+
+	// removed fields are reset, the others are kept
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		removeFieldsParameterName: "allowed_groups,groups_cache_ttl",
+	}); err != nil {
+		t.Fatalf("unexpected error removing fields: %s", err)
+	}
+	c, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.AllowedGroups) != 0 || c.GroupsCacheTTL != 0 {
+		t.Errorf("expected removed fields to be reset, got %v, %v", c.AllowedGroups, c.GroupsCacheTTL)
+	}
+	if !reflect.DeepEqual(c.AllowedDomains, []string{"a.com"}) || c.CLIClientSecret != "cli-secret" {
+		t.Errorf("expected other fields to be kept, got %+v", c)
+	}
+
+	// removing a field required by another one is validated
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		removeFieldsParameterName: cliClientSecretConfigPropertyName,
+	}); err == nil || !strings.Contains(err.Error(), "cli_client_id and cli_client_secret must be set together") {
+		t.Errorf("expected validation error, got %v", err)
+	}
+
+	// delete wipes the config and the cached groups
+	c.GroupsCacheStorage = true
+	if err := b.groupsCache.put(ctx, s, c, "a@a.com", &groupsCacheItem{Fetched: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.DeleteOperation, configPath, nil); err != nil {
+		t.Fatalf("unexpected error deleting config: %s", err)
+	}
+	if entry, err := s.Get(ctx, configEntry); err != nil || entry != nil {
+		t.Errorf("expected config to be deleted, got %v, %v", entry, err)
+	}
+	if keys, err := s.List(ctx, groupsCacheEntry); err != nil || len(keys) != 0 || len(b.groupsCache.items) != 0 {
+		t.Errorf("expected no cached groups, got %v, %v", keys, err)
+	}
+	resp, err := testHandleRequest(t, b, s, logical.ReadOperation, configPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data[cliClientIDConfigPropertyName] != "" || resp.Data[directoryCredentialSourceResponsePropertyName] != credentialSourceNone {
+		t.Errorf("expected empty config after delete, got %v", resp.Data)
+	}
+}
+
+// tests importing clients from a client_secret.json
+func TestBackend_ConfigImport(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	importRequest := func(d map[string]interface{}) (*logical.Response, error) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:  logical.UpdateOperation,
+			Path:       configImportPath,
+			Data:       d,
+			Storage:    s,
+			MountPoint: "auth/google-prod/",
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp != nil && resp.IsError() {
+			return resp, resp.Error()
+		}
+		return resp, nil
+	}
+
+	// installed client for the CLI flow
+	resp, err := importRequest(map[string]interface{}{
+		clientSecretParameterName: `{"installed":{"client_id":"cli-id","client_secret":"cli-secret","redirect_uris":["urn:ietf:wg:oauth:2.0:oob","http://localhost"]}}`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error importing installed client: %s", err)
+	}
+	if resp.Data[clientTypeResponsePropertyName] != typeCLI || len(resp.Warnings) != 0 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	// installed client with loopback redirects only
+	resp, err = importRequest(map[string]interface{}{
+		clientSecretParameterName: `{"installed":{"client_id":"cli-id-2","client_secret":"cli-secret-2","redirect_uris":["http://localhost"]}}`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error importing installed client: %s", err)
+	}
+	if len(resp.Warnings) != 1 {
+		t.Errorf("expected a warning about the loopback redirect, got %v", resp.Warnings)
+	}
+
+	// installed client for the device flow
+	if _, err := importRequest(map[string]interface{}{
+		clientSecretParameterName: `{"installed":{"client_id":"device-id","client_secret":"device-secret"}}`,
+		clientTypeParameterName:   typeDevice,
+	}); err != nil {
+		t.Fatalf("unexpected error importing device client: %s", err)
+	}
+
+	// web client, the redirect URL is derived from the registered URI
+	resp, err = importRequest(map[string]interface{}{
+		clientSecretParameterName: `{"web":{"client_id":"web-id","client_secret":"web-secret","redirect_uris":["https://other.example.com/callback","https://vault.example.com/ui/vault/auth/google/callback/google-prod"]}}`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error importing web client: %s", err)
+	}
+	if exp, act := "https://vault.example.com/ui/vault/auth/google/callback/google-prod", resp.Data[redirectURLResponsePropertyName]; exp != act {
+		t.Errorf("unexpected redirect URL, exp=%s act=%v", exp, act)
+	}
+
+	c, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CLIClientID != "cli-id-2" || c.CLIClientSecret != "cli-secret-2" ||
+		c.DeviceClientID != "device-id" || c.DeviceClientSecret != "device-secret" ||
+		c.WebClientID != "web-id" || c.WebClientSecret != "web-secret" ||
+		c.WebRedirectURL != "https://vault.example.com" {
+		t.Errorf("unexpected config after import: %+v", c)
+	}
+
+	for _, tc := range []struct {
+		data     map[string]interface{}
+		expected string
+	}{
+		{
+			data:     map[string]interface{}{clientSecretParameterName: `not json`},
+			expected: "error parsing client_secret",
+		},
+		{
+			data:     map[string]interface{}{clientSecretParameterName: `{"other":{}}`},
+			expected: "contains neither an installed nor a web client",
+		},
+		{
+			data:     map[string]interface{}{clientSecretParameterName: `{"installed":{"client_id":"cli-id"}}`},
+			expected: "contains no client_id or client_secret",
+		},
+		{
+			data:     map[string]interface{}{clientSecretParameterName: `{"installed":{"client_id":"cli-id","client_secret":"cli-secret","redirect_uris":["https://example.com"]}}`},
+			expected: "none of the redirect URIs of the client can be used by the CLI flow",
+		},
+		{
+			data: map[string]interface{}{
+				clientSecretParameterName: `{"web":{"client_id":"web-id","client_secret":"web-secret","redirect_uris":["https://vault.example.com/ui/vault/auth/google/callback/google-prod"]}}`,
+				clientTypeParameterName:   typeCLI,
+			},
+			expected: "client_type of web clients must be web",
+		},
+		{
+			data:     map[string]interface{}{clientSecretParameterName: `{"web":{"client_id":"web-id","client_secret":"web-secret","redirect_uris":["https://vault.example.com/ui/vault/auth/google/callback/google"]}}`},
+			expected: "none of the redirect URIs of the client point to ui/vault/auth/google/callback/google-prod",
+		},
+	} {
+		if _, err := importRequest(tc.data); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected error %q, got %v", tc.expected, err)
+		}
+	}
+
+	// the redirect URL template has to be registered
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		webRedirectURLTemplateConfigPropertyName: "https://{{mount}}.vault.example.com/callback",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importRequest(map[string]interface{}{
+		clientSecretParameterName: `{"web":{"client_id":"web-id","client_secret":"web-secret","redirect_uris":["https://vault.example.com/ui/vault/auth/google/callback/google-prod"]}}`,
+	}); err == nil || !strings.Contains(err.Error(), "redirect URI https://google-prod.vault.example.com/callback of web_redirect_url_template is not registered") {
+		t.Errorf("expected error about the unregistered template, got %v", err)
+	}
+	if _, err := importRequest(map[string]interface{}{
+		clientSecretParameterName: `{"web":{"client_id":"web-id-2","client_secret":"web-secret","redirect_uris":["https://google-prod.vault.example.com/callback"]}}`,
+	}); err != nil {
+		t.Errorf("unexpected error importing web client: %s", err)
+	}
+}
+
+// tests that the Google endpoints can be replaced
+func TestBackend_Endpoints(t *testing.T) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			fmt.Fprint(w, `{"access_token":"directory-token","token_type":"Bearer","expires_in":3600}`)
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer user-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error":{"code":401,"message":"invalid token"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"email":"a@a.com","hd":"a.com","verified_email":true}`)
+		case "/directory/users/a@a.com":
+			if r.Header.Get("Authorization") != "Bearer directory-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"primaryEmail":"a@a.com","orgUnitPath":"/eng"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:                "cli-id",
+		cliClientSecretConfigPropertyName:            "cli-secret",
+		authURLConfigPropertyName:                    server.URL + "/auth",
+		tokenURLConfigPropertyName:                   server.URL + "/token",
+		userinfoURLConfigPropertyName:                server.URL + "/userinfo",
+		directoryURLConfigPropertyName:               server.URL + "/directory",
+		directoryServiceAccountKeyConfigPropertyName: testServiceAccountKey(t, "https://oauth2.googleapis.com/token"),
+		directoryImpersonateUserConfigPropertyName:   "admin@a.com",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		userinfoURLConfigPropertyName: "localhost/userinfo",
+	}); err == nil || !strings.Contains(err.Error(), "userinfo_url must use the http or https scheme") {
+		t.Errorf("expected invalid userinfo_url to be rejected, got %v", err)
+	}
+
+	resp, err := testHandleRequest(t, b, s, logical.ReadOperation, cliCodeURLPath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading code URL: %s", err)
+	}
+	if codeURL := resp.Data[codeURLResponsePropertyName].(string); !strings.HasPrefix(codeURL, server.URL+"/auth?") {
+		t.Errorf("expected code URL of the auth_url, got %s", codeURL)
+	}
+
+	c, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenURL := c.oauth2Config(typeCLI).Endpoint.TokenURL; tokenURL != server.URL+"/token" {
+		t.Errorf("unexpected token URL: %s", tokenURL)
+	}
+
+	p := &googleProvider{}
+
+	user, err := p.authUser(ctx, c.oauth2Config(typeCLI), c.userinfoURL(), &oauth2.Token{AccessToken: "user-token"})
+	if err != nil {
+		t.Fatalf("unexpected error looking up user: %s", err)
+	}
+	if user.Email != "a@a.com" || user.Hd != "a.com" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+
+	if _, err := p.authUser(ctx, c.oauth2Config(typeCLI), c.userinfoURL(), &oauth2.Token{AccessToken: "other-token"}); err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("expected error of the userinfo endpoint, got %v", err)
+	}
+
+	// the token URL of the key is replaced by token_url
+	account, err := p.lookupUser(ctx, c, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected error looking up account: %s", err)
+	}
+	if account.OrgUnitPath != "/eng" {
+		t.Errorf("unexpected account: %+v", account)
+	}
+}
+
+func TestBackend_Explain(t *testing.T) {
+	ctrl, userMock, groupsMock, b := newTestBackendMocked(t)
+	defer ctrl.Finish()
+
+	s := &logical.InmemStorage{}
+
+	groupA := &admin.Group{Email: "group-a@a.com", Aliases: []string{"alias-a@a.com"}}
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("a@a.com")).AnyTimes().Return([]*admin.Group{groupA}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("b@b.com")).AnyTimes().Return([]*admin.Group{}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("d@a.com")).AnyTimes().Return([]*admin.Group{groupA}, nil)
+	groupsMock.EXPECT().groupsPerUser(gomock.Any(), gomock.Any(), gomock.Eq("c@a.com")).AnyTimes().Return(nil, fmt.Errorf("quota exceeded"))
+
+	// explaining never authenticates a user
+	userMock.EXPECT().authUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		cliClientIDConfigPropertyName:             "cli-id",
+		cliClientSecretConfigPropertyName:         "cli-secret",
+		cliTTLConfigPropertyName:                  "33m",
+		cliMaxTTLConfigPropertyName:               "44m",
+		webTTLConfigPropertyName:                  "11m",
+		webMaxTTLConfigPropertyName:               "22m",
+		allowedGroupsConfigPropertyName:           "glob:alias-*@a.com",
+		deniedUsersConfigPropertyName:             "d@a.com",
+		groupsLookupFailureModeConfigPropertyName: groupsLookupFailureModeDeny,
+		groupsCacheTTLConfigPropertyName:          "1h",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, rolePath+"admins", map[string]interface{}{
+		boundGroupsRolePropertyName: "group-admins@a.com",
+		policiesRolePropertyName:    "admin",
+	}); err != nil {
+		t.Fatalf("unexpected error writing role: %s", err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, rolePath+"users", map[string]interface{}{
+		boundGroupsRolePropertyName: "group-a@a.com",
+		policiesRolePropertyName:    "user",
+		ttlRolePropertyName:         "5m",
+	}); err != nil {
+		t.Fatalf("unexpected error writing role: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		data   map[string]interface{}
+		expect map[string]interface{}
+	}{
+		{
+			name: "allowed by group pattern",
+			data: map[string]interface{}{emailParameterName: "a@a.com", typeParameterName: typeWeb},
+			expect: map[string]interface{}{
+				"allowed":        true,
+				"config_reason":  `allowed by allowed_groups entry "glob:alias-*@a.com" for group alias-a@a.com`,
+				"groups":         []string{"group-a@a.com", "alias-a@a.com"},
+				"group_aliases":  []string{"group-a@a.com", "@a.com"},
+				"policies":       []string{},
+				"ttl":            "11m0s",
+				"max_ttl":        "22m0s",
+				"config_allowed": true,
+			},
+		},
+		{
+			name: "role binding satisfied",
+			data: map[string]interface{}{emailParameterName: "a@a.com", roleParameterName: "users"},
+			expect: map[string]interface{}{
+				"allowed":       true,
+				"config_reason": "not denied, the allowed lists are replaced by the role bindings",
+				"role_allowed":  true,
+				"role_reason":   "all role bindings are satisfied",
+				"policies":      []string{"user"},
+				"ttl":           "5m0s",
+				"max_ttl":       "44m0s",
+				"group_aliases": []string{"group-a@a.com", "@a.com"},
+			},
+		},
+		{
+			name: "role binding failed",
+			data: map[string]interface{}{emailParameterName: "a@a.com", roleParameterName: "admins"},
+			expect: map[string]interface{}{
+				"allowed":        false,
+				"config_allowed": true,
+				"role_allowed":   false,
+				"role_reason":    "no group is in bound_groups",
+			},
+		},
+		{
+			name: "not matched",
+			data: map[string]interface{}{emailParameterName: "b@b.com"},
+			expect: map[string]interface{}{
+				"allowed":        false,
+				"hosted_domain":  "b.com",
+				"config_reason":  "not matched by allowed_users, allowed_groups or allowed_domains",
+				"group_aliases":  []string{"@b.com"},
+				"config_allowed": false,
+				"groups":         []string{},
+				"role":           "",
+				"type":           typeCLI,
+				"email":          "b@b.com",
+				"policies":       []string{},
+				"ttl":            "33m0s",
+				"max_ttl":        "44m0s",
+			},
+		},
+		{
+			name: "denied",
+			data: map[string]interface{}{emailParameterName: "d@a.com"},
+			expect: map[string]interface{}{
+				"allowed":       false,
+				"config_reason": `denied by denied_users entry "d@a.com"`,
+			},
+		},
+		{
+			name: "groups lookup failed",
+			data: map[string]interface{}{emailParameterName: "c@a.com"},
+			expect: map[string]interface{}{
+				"allowed":        false,
+				"groups_error":   "quota exceeded",
+				"groups_reason":  "the lookup failed and groups_lookup_failure_mode is deny",
+				"groups":         []string{},
+				"config_allowed": false,
+				"config_reason":  "not matched by allowed_users, allowed_groups or allowed_domains",
+				"group_aliases":  []string{"@a.com"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := testHandleRequest(t, b, s, logical.ReadOperation, explainPath, tc.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for key, expected := range tc.expect {
+				if actual := resp.Data[key]; !reflect.DeepEqual(actual, expected) {
+					t.Errorf("unexpected %s: expected %#v, got %#v", key, expected, actual)
+				}
+			}
+		})
+	}
+
+	// explaining doesn't fill the groups cache
+	c, err := b.config(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@a.com", "b@b.com", "c@a.com"} {
+		if item, err := b.groupsCache.get(context.Background(), s, c, email); err != nil || item != nil {
+			t.Errorf("expected no cached groups of %s, got %+v, %v", email, item, err)
+		}
+	}
+
+	// unknown roles and missing emails are rejected
+	if _, err := testHandleRequest(t, b, s, logical.ReadOperation, explainPath, map[string]interface{}{
+		emailParameterName: "a@a.com",
+		roleParameterName:  "unknown",
+	}); err == nil || !strings.Contains(err.Error(), `role "unknown" could not be found`) {
+		t.Errorf("expected unknown role error, got %v", err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.ReadOperation, explainPath, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "email is required") {
+		t.Errorf("expected missing email error, got %v", err)
+	}
+}
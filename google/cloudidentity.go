@@ -0,0 +1,185 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultCloudIdentityURL = "https://cloudidentity.googleapis.com/v1/"
+
+	cloudIdentityGroupsReadonlyScope = "https://www.googleapis.com/auth/cloud-identity.groups.readonly"
+
+	// label of Google groups, which excludes security groups without email
+	cloudIdentityDiscussionForumLabel = "cloudidentity.googleapis.com/groups.discussion_forum"
+
+	groupsProviderDirectory     = "directory"
+	groupsProviderCloudIdentity = "cloudidentity"
+	groupsProviderNone          = "none"
+)
+
+var groupsProviders = []string{
+	groupsProviderDirectory,
+	groupsProviderCloudIdentity,
+	groupsProviderNone,
+}
+
+// transitiveGroupsProvider is implemented by group providers, which resolve
+// nested memberships themselves
+type transitiveGroupsProvider interface {
+	transitiveGroupsPerUser(ctx context.Context, config *config, userKey string) ([]*admin.Group, error)
+}
+
+// cloudIdentityProvider looks up groups using the Cloud Identity Groups API,
+// which only requires the Groups Reader role instead of domain-wide delegation
+type cloudIdentityProvider struct {
+	// client, reused until the credentials change
+	clientLock sync.Mutex
+	clientKey  string
+	client     *http.Client
+}
+
+var _ GroupsProvider = &cloudIdentityProvider{}
+var _ transitiveGroupsProvider = &cloudIdentityProvider{}
+var _ clientResetter = &cloudIdentityProvider{}
+
+type cloudIdentityMembership struct {
+	Group    string `json:"group"`
+	GroupKey struct {
+		ID string `json:"id"`
+	} `json:"groupKey"`
+	DisplayName string `json:"displayName"`
+	Description string `json:"description"`
+}
+
+func (p *cloudIdentityProvider) httpClient(ctx context.Context, config *config) (*http.Client, error) {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+
+	key := config.credentialsKey("")
+	if p.client != nil && p.clientKey == key {
+		return p.client, nil
+	}
+
+	client, err := credentialsClient(ctx, config, "", cloudIdentityGroupsReadonlyScope)
+	if err != nil {
+		return nil, err
+	}
+
+	p.clientKey = key
+	p.client = client
+	return p.client, nil
+}
+
+// resetClients drops the cached client
+func (p *cloudIdentityProvider) resetClients() {
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+	p.clientKey = ""
+	p.client = nil
+}
+
+func (p *cloudIdentityProvider) groupsPerUser(ctx context.Context, config *config, userKey string) ([]*admin.Group, error) {
+	return p.searchGroups(ctx, config, "searchDirectGroups", userKey)
+}
+
+func (p *cloudIdentityProvider) transitiveGroupsPerUser(ctx context.Context, config *config, userKey string) ([]*admin.Group, error) {
+	return p.searchGroups(ctx, config, "searchTransitiveGroups", userKey)
+}
+
+// celString quotes the value as string literal of a CEL query, email
+// addresses can contain quotes
+func celString(value string) string {
+	return "'" + celStringReplacer.Replace(value) + "'"
+}
+
+var celStringReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// searchGroups pages through the memberships of the member
+func (p *cloudIdentityProvider) searchGroups(ctx context.Context, config *config, method string, memberKey string) ([]*admin.Group, error) {
+	// skip groups check if service account is not configured
+	if config.credentialSource() == credentialSourceNone {
+		return []*admin.Group{}, nil
+	}
+
+	client, err := p.httpClient(ctx, config)
+	if err != nil {
+		return []*admin.Group{}, err
+	}
+
+	baseURL := config.cloudIdentityURL()
+
+	query := fmt.Sprintf("member_key_id == %s && %s in labels", celString(memberKey), celString(cloudIdentityDiscussionForumLabel))
+
+	groups := []*admin.Group{}
+	pageToken := ""
+	for {
+		params := url.Values{"query": {query}}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, baseURL+"groups/-/memberships:"+method+"?"+params.Encode(), nil)
+		if err != nil {
+			return []*admin.Group{}, err
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return []*admin.Group{}, err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return []*admin.Group{}, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return []*admin.Group{}, &googleapi.Error{
+				Code:    resp.StatusCode,
+				Message: fmt.Sprintf("unexpected response from Cloud Identity %s: %s", method, body),
+			}
+		}
+
+		var result struct {
+			Memberships   []cloudIdentityMembership `json:"memberships"`
+			NextPageToken string                    `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return []*admin.Group{}, fmt.Errorf("error decoding Cloud Identity %s response: %s", method, err)
+		}
+
+		for _, m := range result.Memberships {
+			groups = append(groups, &admin.Group{
+				Id:          m.Group,
+				Email:       m.GroupKey.ID,
+				Name:        m.DisplayName,
+				Description: m.Description,
+			})
+		}
+
+		if result.NextPageToken == "" {
+			break
+		}
+		pageToken = result.NextPageToken
+	}
+
+	return groups, nil
+}
+
+// noGroupsProvider is used if group lookups are disabled
+type noGroupsProvider struct{}
+
+func (p *noGroupsProvider) groupsPerUser(ctx context.Context, config *config, userKey string) ([]*admin.Group, error) {
+	return []*admin.Group{}, nil
+}
@@ -0,0 +1,173 @@
+package google
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/oauth2/google"
+)
+
+var domainRegexp = regexp.MustCompile(`^(?i)([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// validate checks the whole config, every invalid field is reported
+func (c *config) validate(maxLeaseTTL time.Duration) error {
+	var result *multierror.Error
+
+	// client IDs and secrets are required together
+	for _, client := range []struct {
+		idName, secretName string
+		id, secret         string
+	}{
+		{cliClientIDConfigPropertyName, cliClientSecretConfigPropertyName, c.CLIClientID, c.CLIClientSecret},
+		{deviceClientIDConfigPropertyName, deviceClientSecretConfigPropertyName, c.DeviceClientID, c.DeviceClientSecret},
+		{webClientIDConfigPropertyName, webClientSecretConfigPropertyName, c.WebClientID, c.WebClientSecret},
+	} {
+		if (client.id == "") != (client.secret == "") {
+			result = multierror.Append(result, fmt.Errorf("%s and %s must be set together", client.idName, client.secretName))
+		}
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{webRedirectURLConfigPropertyName, c.WebRedirectURL},
+		{webRedirectURLTemplateConfigPropertyName, strings.Replace(c.WebRedirectURLTemplate, mountPlaceholder, "google", -1)},
+		{jwksURLConfigPropertyName, c.JWKSURL},
+		{serviceAccountJWKSURLConfigPropertyName, strings.Replace(c.ServiceAccountJWKSURL, emailPlaceholder, "email", -1)},
+		{revocationURLConfigPropertyName, c.RevocationURL},
+		{authURLConfigPropertyName, c.AuthURL},
+		{tokenURLConfigPropertyName, c.TokenURL},
+		{deviceAuthURLConfigPropertyName, c.DeviceAuthURL},
+		{userinfoURLConfigPropertyName, c.UserinfoURL},
+		{directoryURLConfigPropertyName, c.DirectoryURL},
+		{cloudIdentityURLConfigPropertyName, c.CloudIdentityURL},
+		{iamCredentialsURLConfigPropertyName, c.IAMCredentialsURL},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if err := validateURL(field.value); err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s %s", field.name, err))
+		}
+	}
+
+	// negative durations are already rejected by the field parsing
+	for _, field := range []struct {
+		name    string
+		ttl     time.Duration
+		maxName string
+		maxTTL  time.Duration
+	}{
+		{cliTTLConfigPropertyName, c.CLITTL, cliMaxTTLConfigPropertyName, c.CLIMaxTTL},
+		{webTTLConfigPropertyName, c.WebTTL, webMaxTTLConfigPropertyName, c.WebMaxTTL},
+	} {
+		if field.maxTTL > 0 && field.ttl > field.maxTTL {
+			result = multierror.Append(result, fmt.Errorf("%s must not be greater than %s", field.name, field.maxName))
+		}
+		if maxLeaseTTL > 0 && field.maxTTL > maxLeaseTTL {
+			result = multierror.Append(result, fmt.Errorf("%s must not be greater than the mount's max TTL of %s", field.maxName, maxLeaseTTL))
+		}
+		if maxLeaseTTL > 0 && field.ttl > maxLeaseTTL {
+			result = multierror.Append(result, fmt.Errorf("%s must not be greater than the mount's max TTL of %s", field.name, maxLeaseTTL))
+		}
+	}
+
+	if c.GroupsMaxDepth < 0 {
+		result = multierror.Append(result, fmt.Errorf("%s must not be negative", groupsMaxDepthConfigPropertyName))
+	}
+
+	if c.DirectoryServiceAccounyKey != "" {
+		if _, err := google.JWTConfigFromJSON([]byte(c.DirectoryServiceAccounyKey)); err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s is not a valid service account key: %s", directoryServiceAccountKeyConfigPropertyName, err))
+		}
+	}
+
+	for _, field := range []struct {
+		name   string
+		values []string
+	}{
+		{directoryImpersonateUserConfigPropertyName, []string{c.DirectoryImpersonateUser}},
+		{directoryServiceAccountEmailConfigPropertyName, []string{c.DirectoryServiceAccountEmail}},
+		{allowedUsersConfigPropertyName, c.AllowedUsers},
+		{allowedGroupsConfigPropertyName, c.AllowedGroups},
+		{deniedUsersConfigPropertyName, c.DeniedUsers},
+		{deniedGroupsConfigPropertyName, c.DeniedGroups},
+	} {
+		for _, value := range field.values {
+			if isPattern(value) {
+				if _, err := compilePattern(value); err != nil {
+					result = multierror.Append(result, fmt.Errorf("%s contains an %s", field.name, err))
+				}
+				continue
+			}
+			if value != "" && !validEmail(value) {
+				result = multierror.Append(result, fmt.Errorf("%s contains an invalid email address: %q", field.name, value))
+			}
+		}
+	}
+
+	for _, field := range []struct {
+		name    string
+		domains []string
+	}{
+		{allowedDomainsConfigPropertyName, c.AllowedDomains},
+		{deniedDomainsConfigPropertyName, c.DeniedDomains},
+	} {
+		for _, domain := range field.domains {
+			if isPattern(domain) {
+				if _, err := compilePattern(domain); err != nil {
+					result = multierror.Append(result, fmt.Errorf("%s contains an %s", field.name, err))
+				}
+				continue
+			}
+			if !domainRegexp.MatchString(domain) {
+				result = multierror.Append(result, fmt.Errorf("%s contains an invalid domain: %q", field.name, domain))
+			}
+		}
+	}
+
+	for _, orgUnit := range c.AllowedOrgUnits {
+		if !strings.HasPrefix(orgUnit, "/") {
+			result = multierror.Append(result, fmt.Errorf("%s contains an invalid org unit path, it needs to start with /: %q", allowedOrgUnitsConfigPropertyName, orgUnit))
+		}
+	}
+
+	if c.GroupsLookupFailureMode != "" && !stringInSlice(c.GroupsLookupFailureMode, groupsLookupFailureModes) {
+		result = multierror.Append(result, fmt.Errorf("%s must be one of %s", groupsLookupFailureModeConfigPropertyName, strings.Join(groupsLookupFailureModes, ", ")))
+	}
+
+	if c.GroupsProvider != "" && !stringInSlice(c.GroupsProvider, groupsProviders) {
+		result = multierror.Append(result, fmt.Errorf("%s must be one of %s", groupsProviderConfigPropertyName, strings.Join(groupsProviders, ", ")))
+	}
+
+	return result.ErrorOrNil()
+}
+
+// validateURL checks for an absolute http(s) URL
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("is not a valid URL: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must use the http or https scheme: %q", value)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("must contain a host: %q", value)
+	}
+	return nil
+}
+
+func validEmail(value string) bool {
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		return false
+	}
+	return domainRegexp.MatchString(value[strings.LastIndex(value, "@")+1:])
+}
@@ -0,0 +1,163 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+)
+
+const (
+	credentialSourceServiceAccountKey = "service_account_key"
+	credentialSourceSignJWT           = "application_default_sign_jwt"
+	credentialSourceNone              = "none"
+
+	jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+	defaultIAMCredentialsURL = "https://iamcredentials.googleapis.com/"
+
+	// timeout of signing and exchanging a JWT for a token, tokens are
+	// refreshed outside of the requests using them
+	credentialsTokenTimeout = 30 * time.Second
+)
+
+// credentialSource returns the credentials used for Google API lookups, a
+// service account key takes precedence over Application Default Credentials
+func (c *config) credentialSource() string {
+	if c.DirectoryServiceAccounyKey != "" {
+		return credentialSourceServiceAccountKey
+	}
+	if c.DirectoryServiceAccountEmail != "" {
+		return credentialSourceSignJWT
+	}
+	return credentialSourceNone
+}
+
+// directoryConfigured returns if Admin SDK lookups are configured, they
+// require a user to impersonate
+func (c *config) directoryConfigured() bool {
+	return c.DirectoryImpersonateUser != "" && c.credentialSource() != credentialSourceNone
+}
+
+// credentialsKey identifies the credentials, so clients can be reused
+func (c *config) credentialsKey(subject string) string {
+	return strings.Join([]string{c.DirectoryServiceAccounyKey, c.DirectoryServiceAccountEmail, c.TokenURL, c.IAMCredentialsURL, subject}, "\x00")
+}
+
+// credentialsClient returns a client authenticated for the scopes, which
+// acts as the subject if set. The client outlives the request, its access
+// tokens are refreshed independent of a request's context, only the HTTP
+// client set in the context is used.
+func credentialsClient(ctx context.Context, config *config, subject string, scopes ...string) (*http.Client, error) {
+	base := httpClient(ctx)
+	ctx = context.WithValue(context.Background(), oauth2.HTTPClient, base)
+
+	switch config.credentialSource() {
+	case credentialSourceServiceAccountKey:
+		jwtConfig, err := google.JWTConfigFromJSON([]byte(config.DirectoryServiceAccounyKey), scopes...)
+		if err != nil {
+			return nil, err
+		}
+		jwtConfig.Subject = subject
+		// the token URL of the key is only overridden if configured
+		if config.TokenURL != "" {
+			jwtConfig.TokenURL = config.TokenURL
+		}
+		return jwtConfig.Client(ctx), nil
+	case credentialSourceSignJWT:
+		creds, err := google.FindDefaultCredentials(ctx, iamcredentials.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("error finding application default credentials: %s", err)
+		}
+		iamService, err := iamcredentials.New(oauth2.NewClient(ctx, creds.TokenSource))
+		if err != nil {
+			return nil, err
+		}
+		iamService.BasePath = config.iamCredentialsURL()
+		return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, &signJWTTokenSource{
+			iam:      iamService,
+			client:   base,
+			email:    config.DirectoryServiceAccountEmail,
+			subject:  subject,
+			scopes:   scopes,
+			tokenURL: config.tokenURL(),
+		})), nil
+	default:
+		return nil, errors.New("no credentials configured for Google API lookups")
+	}
+}
+
+// signJWTTokenSource gets tokens for a service account without a key, the
+// JWT assertion is signed by the IAM Credentials API using the application
+// default credentials, which need the Service Account Token Creator role.
+type signJWTTokenSource struct {
+	iam      *iamcredentials.Service
+	client   *http.Client
+	email    string
+	subject  string
+	scopes   []string
+	tokenURL string
+}
+
+func (s *signJWTTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), oauth2.HTTPClient, s.client), credentialsTokenTimeout)
+	defer cancel()
+	now := time.Now()
+
+	claims := map[string]interface{}{
+		"iss":   s.email,
+		"scope": strings.Join(s.scopes, " "),
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	if s.subject != "" {
+		claims["sub"] = s.subject
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := s.iam.Projects.ServiceAccounts.SignJwt(
+		"projects/-/serviceAccounts/"+s.email,
+		&iamcredentials.SignJwtRequest{Payload: string(payload)},
+	).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error signing JWT for %s: %s", s.email, err)
+	}
+
+	body, err := postForm(ctx, s.tokenURL, url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {signed.SignedJwt},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging JWT for %s: %s", s.email, err)
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding token response: %s", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.New("token response contains no access token")
+	}
+
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   resp.TokenType,
+		Expiry:      now.Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
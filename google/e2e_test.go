@@ -0,0 +1,447 @@
+package google
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/simonswine/vault-plugin-auth-google/internal/fakegoogle"
+)
+
+const (
+	e2eClientID       = "cli-id.apps.googleusercontent.com"
+	e2eClientSecret   = "cli-secret"
+	e2eServiceAccount = "groups@my-project.iam.gserviceaccount.com"
+)
+
+// newE2EServer starts a fake Google with a user a@a.com, who is a member of
+// group-a and group-b directly and of parent through group-a, and a user
+// b@a.com without groups
+func newE2EServer(t *testing.T) *fakegoogle.Server {
+	server, err := fakegoogle.New(e2eClientID, e2eClientSecret)
+	if err != nil {
+		t.Fatalf("unable to start fake Google: %s", err)
+	}
+
+	server.AddUser(&fakegoogle.User{
+		Email:         "a@a.com",
+		HostedDomain:  "a.com",
+		Name:          "User A",
+		EnrolledIn2SV: true,
+		OrgUnitPath:   "/eng",
+		Groups:        []string{"group-a@a.com", "group-b@a.com"},
+	})
+	server.AddUser(&fakegoogle.User{
+		Email:         "b@a.com",
+		HostedDomain:  "a.com",
+		EnrolledIn2SV: true,
+	})
+	server.AddGroup(&fakegoogle.Group{Email: "group-a@a.com", Name: "Group A", Groups: []string{"parent@a.com"}})
+	server.AddGroup(&fakegoogle.Group{Email: "group-b@a.com", Name: "Group B"})
+	server.AddGroup(&fakegoogle.Group{Email: "parent@a.com", Name: "Parent"})
+
+	return server
+}
+
+// newE2EBackend returns a backend using the real Google providers, which is
+// configured to use the fake Google
+func newE2EBackend(t *testing.T, server *fakegoogle.Server, d map[string]interface{}) (*backend, logical.Storage) {
+	b, err := newTestBackend()
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+	s := &logical.InmemStorage{}
+
+	serviceAccountKey, err := server.AddServiceAccount(e2eServiceAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]interface{}{
+		cliClientIDConfigPropertyName:                e2eClientID,
+		cliClientSecretConfigPropertyName:            e2eClientSecret,
+		cliTTLConfigPropertyName:                     "1h",
+		cliMaxTTLConfigPropertyName:                  "2h",
+		authURLConfigPropertyName:                    server.AuthURL(),
+		tokenURLConfigPropertyName:                   server.TokenURL(),
+		userinfoURLConfigPropertyName:                server.UserinfoURL(),
+		directoryURLConfigPropertyName:               server.DirectoryURL(),
+		revocationURLConfigPropertyName:              server.RevocationURL(),
+		jwksURLConfigPropertyName:                    server.JWKSURL(),
+		serviceAccountJWKSURLConfigPropertyName:      server.ServiceAccountJWKSURL(),
+		directoryServiceAccountKeyConfigPropertyName: serviceAccountKey,
+		directoryImpersonateUserConfigPropertyName:   "admin@a.com",
+	}
+	for k, v := range d {
+		data[k] = v
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, data); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	return b, s
+}
+
+// testCodeLogin logs in the user with the code flow of the CLI
+func testCodeLogin(t *testing.T, b *backend, s logical.Storage, server *fakegoogle.Server, email string) (*logical.Response, error) {
+	resp, err := testHandleRequest(t, b, s, logical.ReadOperation, cliCodeURLPath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading code URL: %s", err)
+	}
+
+	code, err := server.Authorize(resp.Data[codeURLResponsePropertyName].(string), email)
+	if err != nil {
+		t.Fatalf("unexpected error authorizing: %s", err)
+	}
+
+	return testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		googleAuthCodeParameterName: code,
+		stateParameterName:          resp.Data[stateParameterName],
+	})
+}
+
+func groupAliasNames(auth *logical.Auth) []string {
+	names := []string{}
+	for _, alias := range auth.GroupAliases {
+		names = append(names, alias.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tests the code login and renewal against the fake Google
+func TestE2E_CodeLogin(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	// tokens are refreshed whenever they are used
+	server.TokenLifetime = 5 * time.Second
+	server.GroupsPageSize = 1
+
+	b, s := newE2EBackend(t, server, map[string]interface{}{
+		allowedGroupsConfigPropertyName:         "parent@a.com",
+		groupsTransitiveConfigPropertyName:      true,
+		validateAccountStatusConfigPropertyName: true,
+		require2SVConfigPropertyName:            true,
+	})
+
+	resp, err := testCodeLogin(t, b, s, server, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	if exp, act := "a@a.com", resp.Auth.Alias.Name; exp != act {
+		t.Errorf("unexpected alias, exp=%s act=%s", exp, act)
+	}
+	if exp, act := []string{"@a.com", "group-a@a.com", "group-b@a.com", "parent@a.com"}, groupAliasNames(resp.Auth); !reflect.DeepEqual(exp, act) {
+		t.Errorf("unexpected group aliases, exp=%v act=%v", exp, act)
+	}
+
+	// groups of the user are paged, one request per group and one for the
+	// parents of every group
+	if calls := server.Calls("/admin/directory/v1/groups"); calls != 5 {
+		t.Errorf("expected 5 group list requests, got %d", calls)
+	}
+
+	// the stored token is refreshed on renewal
+	tokenCalls := server.Calls("/token")
+	if _, err := testRenew(t, b, s, resp.Auth); err != nil {
+		t.Fatalf("unexpected renew error: %s", err)
+	}
+	if server.Calls("/token") <= tokenCalls {
+		t.Error("expected the token to be refreshed on renewal")
+	}
+
+	// users not in the allowed group are denied
+	if _, err := testCodeLogin(t, b, s, server, "b@a.com"); err == nil || !strings.Contains(err.Error(), "user is not allowed to login") {
+		t.Errorf("expected user without groups to be denied, got %v", err)
+	}
+
+	// suspended users can't renew
+	server.AddUser(&fakegoogle.User{
+		Email:         "a@a.com",
+		HostedDomain:  "a.com",
+		Suspended:     true,
+		EnrolledIn2SV: true,
+		Groups:        []string{"group-a@a.com", "group-b@a.com"},
+	})
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil || !strings.Contains(err.Error(), "suspended") {
+		t.Errorf("expected renew of suspended user to fail, got %v", err)
+	}
+}
+
+// tests code logins, which don't supply the state, with and without PKCE
+// being required
+func TestE2E_CodeLoginWithoutState(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	b, s := newE2EBackend(t, server, nil)
+
+	loginWithoutState := func() (*logical.Response, error) {
+		resp, err := testHandleRequest(t, b, s, logical.ReadOperation, cliCodeURLPath, nil)
+		if err != nil {
+			t.Fatalf("unexpected error reading code URL: %s", err)
+		}
+
+		code, err := server.Authorize(resp.Data[codeURLResponsePropertyName].(string), "a@a.com")
+		if err != nil {
+			t.Fatalf("unexpected error authorizing: %s", err)
+		}
+
+		return testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+			googleAuthCodeParameterName: code,
+		})
+	}
+
+	if _, err := loginWithoutState(); err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		requirePKCEConfigPropertyName: true,
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	if _, err := loginWithoutState(); err == nil || !strings.Contains(err.Error(), "a state is required to login with a code") {
+		t.Errorf("expected login without state to be rejected, got: %v", err)
+	}
+	if _, err := testCodeLogin(t, b, s, server, "a@a.com"); err != nil {
+		t.Errorf("unexpected login error: %s", err)
+	}
+}
+
+// tests that failed group lookups are handled according to the failure mode
+func TestE2E_GroupsLookupFailure(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	b, s := newE2EBackend(t, server, map[string]interface{}{
+		allowedGroupsConfigPropertyName:           "group-b@a.com",
+		groupsLookupFailureModeConfigPropertyName: groupsLookupFailureModeDeny,
+	})
+
+	server.FailGroups(http.StatusServiceUnavailable)
+	if _, err := testCodeLogin(t, b, s, server, "a@a.com"); err == nil {
+		t.Error("expected login to fail while groups can't be looked up")
+	}
+
+	resp, err := testCodeLogin(t, b, s, server, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	if exp, act := []string{"@a.com", "group-a@a.com", "group-b@a.com"}, groupAliasNames(resp.Auth); !reflect.DeepEqual(exp, act) {
+		t.Errorf("unexpected group aliases, exp=%v act=%v", exp, act)
+	}
+
+	server.FailGroups(http.StatusForbidden)
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil {
+		t.Error("expected renew to fail while groups can't be looked up")
+	}
+}
+
+// tests that failed group lookups can't be used to escape denied_groups
+func TestE2E_GroupsLookupFailureDeniedGroups(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	b, s := newE2EBackend(t, server, map[string]interface{}{
+		deniedGroupsConfigPropertyName:            "group-c@a.com",
+		groupsLookupFailureModeConfigPropertyName: groupsLookupFailureModeAllow,
+	})
+
+	server.FailGroups(http.StatusServiceUnavailable)
+	if _, err := testCodeLogin(t, b, s, server, "a@a.com"); err == nil {
+		t.Error("expected login to fail without known groups")
+	}
+
+	resp, err := testCodeLogin(t, b, s, server, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+
+	// the groups of the last successful lookup are used instead
+	server.FailGroups(http.StatusServiceUnavailable)
+	if resp, err := testRenew(t, b, s, resp.Auth); err != nil {
+		t.Errorf("unexpected renew error: %s", err)
+	} else if exp, act := []string{"@a.com", "group-a@a.com", "group-b@a.com"}, groupAliasNames(resp.Auth); !reflect.DeepEqual(exp, act) {
+		t.Errorf("unexpected group aliases, exp=%v act=%v", exp, act)
+	}
+
+	// writing the config purges the cached groups
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		deniedGroupsConfigPropertyName: "group-b@a.com",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+	server.FailGroups(http.StatusServiceUnavailable)
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil {
+		t.Error("expected renew of a denied user to fail while groups can't be looked up")
+	}
+}
+
+// tests that the Google token of an expired login is revoked
+func TestE2E_TokenRevocation(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	// tokens are refreshed whenever they are used
+	server.TokenLifetime = 5 * time.Second
+
+	b, s := newE2EBackend(t, server, nil)
+	ctx := context.Background()
+
+	resp, err := testCodeLogin(t, b, s, server, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+
+	grantID := resp.Auth.InternalData["grant"].(string)
+	g, err := b.grant(ctx, s, grantID)
+	if err != nil || g == nil {
+		t.Fatalf("expected grant, got %v, %v", g, err)
+	}
+	g.Expires = time.Now().Add(-time.Second)
+	if err := b.putGrant(ctx, s, grantID, g); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.revokeExpiredGrants(ctx, &logical.Request{Storage: s}); err != nil {
+		t.Fatalf("unexpected error revoking grants: %s", err)
+	}
+	if revoked := server.Revoked(); len(revoked) != 1 || !strings.HasPrefix(revoked[0], "refresh-") {
+		t.Errorf("expected the refresh token to be revoked, got %v", revoked)
+	}
+
+	// the revoked token can't be used anymore
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil {
+		t.Error("expected renew with a revoked token to fail")
+	}
+}
+
+// tests logins with ID tokens of users and service accounts
+func TestE2E_JWTLogin(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	b, s := newE2EBackend(t, server, map[string]interface{}{
+		allowedDomainsConfigPropertyName: "a.com",
+	})
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, rolePath+"workload", map[string]interface{}{
+		boundServiceAccountsRolePropertyName: "workload@my-project.iam.gserviceaccount.com",
+		policiesRolePropertyName:             "workload",
+	}); err != nil {
+		t.Fatalf("unexpected error writing role: %s", err)
+	}
+
+	// user
+	idToken, err := server.IDToken("a@a.com", e2eClientID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		jwtParameterName: idToken,
+	})
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+	if exp, act := []string{"@a.com", "group-a@a.com", "group-b@a.com"}, groupAliasNames(resp.Auth); !reflect.DeepEqual(exp, act) {
+		t.Errorf("unexpected group aliases, exp=%v act=%v", exp, act)
+	}
+
+	// token for another audience
+	idToken, err = server.IDToken("a@a.com", "other-client", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		jwtParameterName: idToken,
+	}); err == nil || !strings.Contains(err.Error(), "audience") {
+		t.Errorf("expected token of another audience to be rejected, got %v", err)
+	}
+
+	// Google-signed token of a service account
+	idToken, err = server.IDToken("workload@my-project.iam.gserviceaccount.com", e2eClientID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		jwtParameterName:  idToken,
+		roleParameterName: "workload",
+	})
+	if err != nil {
+		t.Fatalf("unexpected service account login error: %s", err)
+	}
+	if exp, act := []string{"workload"}, resp.Auth.Policies; !reflect.DeepEqual(exp, act) {
+		t.Errorf("unexpected policies, exp=%v act=%v", exp, act)
+	}
+}
+
+// tests that denied users are rejected on login and renewal
+func TestE2E_DeniedLists(t *testing.T) {
+	server := newE2EServer(t)
+	defer server.Close()
+
+	b, s := newE2EBackend(t, server, map[string]interface{}{
+		allowedDomainsConfigPropertyName: "a.com",
+	})
+
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, rolePath+"workload", map[string]interface{}{
+		boundProjectsRolePropertyName: "my-project",
+	}); err != nil {
+		t.Fatalf("unexpected error writing role: %s", err)
+	}
+
+	resp, err := testCodeLogin(t, b, s, server, "a@a.com")
+	if err != nil {
+		t.Fatalf("unexpected login error: %s", err)
+	}
+
+	idToken, err := server.IDToken("workload@my-project.iam.gserviceaccount.com", e2eClientID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saResp, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		jwtParameterName:  idToken,
+		roleParameterName: "workload",
+	})
+	if err != nil {
+		t.Fatalf("unexpected service account login error: %s", err)
+	}
+
+	// a group of the user is denied
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, configPath, map[string]interface{}{
+		deniedGroupsConfigPropertyName: "group-b@a.com",
+		deniedUsersConfigPropertyName:  "glob:workload@*",
+	}); err != nil {
+		t.Fatalf("unexpected error writing config: %s", err)
+	}
+
+	if _, err := testRenew(t, b, s, resp.Auth); err == nil || !strings.Contains(err.Error(), "user is not allowed to login") {
+		t.Errorf("expected renew of denied user to fail, got %v", err)
+	}
+	if _, err := testCodeLogin(t, b, s, server, "a@a.com"); err == nil || !strings.Contains(err.Error(), "user is not allowed to login") {
+		t.Errorf("expected login of denied user to fail, got %v", err)
+	}
+	if _, err := testCodeLogin(t, b, s, server, "b@a.com"); err != nil {
+		t.Errorf("unexpected login error of other user: %s", err)
+	}
+
+	if _, err := testRenew(t, b, s, saResp.Auth); err == nil || !strings.Contains(err.Error(), "service account is not allowed to login") {
+		t.Errorf("expected renew of denied service account to fail, got %v", err)
+	}
+	if _, err := testHandleRequest(t, b, s, logical.UpdateOperation, loginPath, map[string]interface{}{
+		jwtParameterName:  idToken,
+		roleParameterName: "workload",
+	}); err == nil || !strings.Contains(err.Error(), "service account is not allowed to login") {
+		t.Errorf("expected login of denied service account to fail, got %v", err)
+	}
+}
@@ -1 +1,271 @@
 package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/admin/directory/v1"
+)
+
+const (
+	groupsCacheEntry = "groups/"
+
+	// nesting depth of groups resolved transitively, if not configured
+	defaultGroupsMaxDepth = 5
+
+	// timeout of a group lookup, which is shared by concurrent logins
+	groupsLookupTimeout = 30 * time.Second
+
+	// handling of failed group lookups
+	groupsLookupFailureModeAllow  = "allow"
+	groupsLookupFailureModeDeny   = "deny"
+	groupsLookupFailureModeCached = "cached"
+)
+
+var groupsLookupFailureModes = []string{
+	groupsLookupFailureModeAllow,
+	groupsLookupFailureModeDeny,
+	groupsLookupFailureModeCached,
+}
+
+// groupsCacheItem is the result of the last group lookups of a user
+type groupsCacheItem struct {
+	Groups  []*admin.Group `json:"groups"`
+	Fetched time.Time      `json:"fetched"`
+
+	// set if the last lookup failed
+	Error     string    `json:"error,omitempty"`
+	ErrorTime time.Time `json:"error_time,omitempty"`
+}
+
+// fresh returns if the item can be used instead of looking up the groups
+func (i *groupsCacheItem) fresh(config *config, now time.Time) bool {
+	if i.Error != "" {
+		return now.Sub(i.ErrorTime) < config.GroupsCacheNegativeTTL
+	}
+	return now.Sub(i.Fetched) < config.GroupsCacheTTL
+}
+
+// groupsCache keeps the groups of users in memory and optionally in storage
+type groupsCache struct {
+	lock  sync.Mutex
+	items map[string]*groupsCacheItem
+
+	lookups singleflight.Group
+}
+
+func newGroupsCache() *groupsCache {
+	return &groupsCache{
+		items: make(map[string]*groupsCacheItem),
+	}
+}
+
+func (c *groupsCache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items = make(map[string]*groupsCacheItem)
+}
+
+// purge removes every cached item from memory and storage
+func (c *groupsCache) purge(ctx context.Context, s logical.Storage) error {
+	c.flush()
+
+	keys, err := s.List(ctx, groupsCacheEntry)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete(ctx, groupsCacheEntry+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *groupsCache) get(ctx context.Context, s logical.Storage, config *config, key string) (*groupsCacheItem, error) {
+	c.lock.Lock()
+	item, ok := c.items[key]
+	c.lock.Unlock()
+	if ok || !config.GroupsCacheStorage {
+		return item, nil
+	}
+
+	entry, err := s.Get(ctx, groupsCacheEntry+key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	item = &groupsCacheItem{}
+	if err := entry.DecodeJSON(item); err != nil {
+		return nil, fmt.Errorf("error reading cached groups: %s", err)
+	}
+
+	c.lock.Lock()
+	c.items[key] = item
+	c.lock.Unlock()
+
+	return item, nil
+}
+
+func (c *groupsCache) put(ctx context.Context, s logical.Storage, config *config, key string, item *groupsCacheItem) error {
+	c.lock.Lock()
+	c.items[key] = item
+	c.lock.Unlock()
+
+	if !config.GroupsCacheStorage {
+		return nil
+	}
+
+	entry, err := logical.StorageEntryJSON(groupsCacheEntry+key, item)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// lookupGroups returns the groups of the user, cached results are used if
+// the cache is enabled. Concurrent lookups for the same user are only
+// performed once.
+func (b *backend) lookupGroups(ctx context.Context, s logical.Storage, config *config, userKey string) ([]*admin.Group, error) {
+	// the last known groups are required to handle failed lookups with the
+	// cached failure mode
+	if config.GroupsCacheTTL <= 0 && config.GroupsCacheNegativeTTL <= 0 && config.groupsLookupFailureMode() != groupsLookupFailureModeCached {
+		return b.fetchGroups(ctx, config, userKey)
+	}
+
+	key := strings.ToLower(userKey)
+
+	item, err := b.groupsCache.get(ctx, s, config, key)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil && item.fresh(config, time.Now()) {
+		if item.Error != "" {
+			return nil, errors.New(item.Error)
+		}
+		return item.Groups, nil
+	}
+
+	// the lookup is shared by concurrent logins, so it's not canceled with
+	// the request of the login, which started it
+	ch := b.groupsCache.lookups.DoChan(key, func() (interface{}, error) {
+		lookupCtx, cancel := context.WithTimeout(context.Background(), groupsLookupTimeout)
+		defer cancel()
+
+		groups, err := b.fetchGroups(lookupCtx, config, userKey)
+
+		// lookups which timed out aren't cached as failed
+		if isContextError(err) {
+			return groups, err
+		}
+
+		now := time.Now()
+		newItem := &groupsCacheItem{}
+		if item != nil {
+			*newItem = *item
+		}
+		if err != nil {
+			newItem.Error = err.Error()
+			newItem.ErrorTime = now
+		} else {
+			newItem.Groups = groups
+			newItem.Fetched = now
+			newItem.Error = ""
+			newItem.ErrorTime = time.Time{}
+		}
+
+		if putErr := b.groupsCache.put(lookupCtx, s, config, key, newItem); putErr != nil {
+			// storage might be read-only e.g. on performance standbys
+			b.Logger().Debug("unable to store cached groups", "user", userKey, "error", putErr)
+		}
+
+		return groups, err
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	return result.Val.([]*admin.Group), nil
+}
+
+// isContextError returns if the error is caused by a canceled or timed out
+// context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// groupsProvider returns the configured provider for group lookups
+func (b *backend) groupsProvider(config *config) GroupsProvider {
+	switch config.GroupsProvider {
+	case groupsProviderCloudIdentity:
+		return b.cloudIdentity
+	case groupsProviderNone:
+		return &noGroupsProvider{}
+	default:
+		return b.groups
+	}
+}
+
+// fetchGroups returns the groups of the user, if configured including the
+// groups the user is a member of through other groups
+func (b *backend) fetchGroups(ctx context.Context, config *config, userKey string) ([]*admin.Group, error) {
+	provider := b.groupsProvider(config)
+
+	if config.GroupsTransitive {
+		if p, ok := provider.(transitiveGroupsProvider); ok {
+			return p.transitiveGroupsPerUser(ctx, config, userKey)
+		}
+	}
+
+	groups, err := provider.groupsPerUser(ctx, config, userKey)
+	if err != nil || !config.GroupsTransitive {
+		return groups, err
+	}
+
+	// walk up the parent groups breadth first, every group is only visited
+	// once to handle membership cycles
+	visited := make(map[string]bool)
+	result := []*admin.Group{}
+	current := groups
+	for depth := 1; len(current) > 0; depth++ {
+		var next []*admin.Group
+		for _, group := range current {
+			key := strings.ToLower(group.Email)
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			result = append(result, group)
+
+			// parents beyond the maximum depth are ignored
+			if depth >= config.groupsMaxDepth() {
+				continue
+			}
+
+			parents, err := provider.groupsPerUser(ctx, config, group.Email)
+			if err != nil {
+				return nil, fmt.Errorf("error looking up parent groups of %s: %w", group.Email, err)
+			}
+			next = append(next, parents...)
+		}
+		current = next
+	}
+
+	return result, nil
+}
@@ -0,0 +1,308 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/googleapi"
+	goauth "google.golang.org/api/oauth2/v2"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	defaultJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+	// how long a key set is cached if the response doesn't specify a max-age
+	jwksDefaultCacheDuration = time.Hour
+
+	// minimum duration between key set refreshes caused by unknown key ids
+	jwksMinRefreshInterval = time.Minute
+
+	// how long an expired key set is still used if refreshing it fails
+	jwksStaleDuration = time.Hour
+
+	// timeout of a key set fetch, which is shared by concurrent logins
+	jwksFetchTimeout = 30 * time.Second
+
+	// allowed clock skew when validating the ID token times
+	jwtLeeway = time.Minute
+)
+
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// jwksCache keeps the key sets fetched from JWKS URLs until they expire
+type jwksCache struct {
+	client *http.Client
+
+	lock    sync.Mutex
+	entries map[string]*jwksEntry
+
+	fetches singleflight.Group
+}
+
+type jwksEntry struct {
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+	expires time.Time
+}
+
+func newJWKSCache() *jwksCache {
+	return &jwksCache{
+		client:  cleanhttp.DefaultClient(),
+		entries: make(map[string]*jwksEntry),
+	}
+}
+
+func (c *jwksCache) entry(url string) *jwksEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[url]
+}
+
+// key returns the key for the key id, the key set is fetched if it's not
+// cached, expired or doesn't contain the key id.
+func (c *jwksCache) key(ctx context.Context, url string, kid string) (*jose.JSONWebKey, error) {
+	now := time.Now()
+
+	entry := c.entry(url)
+	if entry == nil || now.After(entry.expires) {
+		var err error
+		if entry, err = c.refresh(ctx, url, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if keys := entry.keys.Key(kid); len(keys) > 0 {
+		return &keys[0], nil
+	}
+
+	// the key might have been rotated, refresh the key set but prevent
+	// unknown key ids from causing a request for every login
+	if now.Sub(entry.fetched) > jwksMinRefreshInterval {
+		var err error
+		if entry, err = c.refresh(ctx, url, entry); err != nil {
+			return nil, err
+		}
+		if keys := entry.keys.Key(kid); len(keys) > 0 {
+			return &keys[0], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no key found for key id '%s'", kid)
+}
+
+// refresh fetches the key set, concurrent refreshes of the same URL share a
+// single request. The request isn't bound to the context of the caller, which
+// only stops waiting for it. If the fetch fails, the previous key set is used
+// until it's expired for longer than jwksStaleDuration.
+func (c *jwksCache) refresh(ctx context.Context, url string, previous *jwksEntry) (*jwksEntry, error) {
+	ch := c.fetches.DoChan(url, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+		defer cancel()
+		return c.fetch(fetchCtx, url)
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if result.Err != nil {
+		if previous != nil && time.Now().Before(previous.expires.Add(jwksStaleDuration)) {
+			return previous, nil
+		}
+		return nil, result.Err
+	}
+
+	return result.Val.(*jwksEntry), nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context, url string) (*jwksEntry, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching JWKS: unexpected status code %d", resp.StatusCode)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("error decoding JWKS: %s", err)
+	}
+
+	now := time.Now()
+	entry := &jwksEntry{
+		keys:    &keys,
+		fetched: now,
+		expires: now.Add(cacheDuration(resp.Header.Get("Cache-Control"))),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// drop stale key sets, so key sets of service accounts don't pile up
+	for u, e := range c.entries {
+		if now.After(e.expires.Add(jwksStaleDuration)) {
+			delete(c.entries, u)
+		}
+	}
+	c.entries[url] = entry
+
+	return entry, nil
+}
+
+// cacheDuration returns the max-age of a Cache-Control header
+func cacheDuration(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds <= 0 {
+			break
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return jwksDefaultCacheDuration
+}
+
+// flexibleBool handles boolean claims, which are sometimes encoded as strings
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = flexibleBool(v)
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*b = flexibleBool(parsed)
+	default:
+		return fmt.Errorf("unexpected type for boolean claim: %T", value)
+	}
+	return nil
+}
+
+type idTokenClaims struct {
+	jwt.Claims
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	HostedDomain  string       `json:"hd"`
+	GivenName     string       `json:"given_name"`
+	FamilyName    string       `json:"family_name"`
+}
+
+// verifyIDToken verifies the signature and claims of a Google-signed ID token
+// and returns the user it was issued for.
+func (b *backend) verifyIDToken(ctx context.Context, config *config, rawToken string) (*goauth.Userinfoplus, error) {
+	token, header, err := parseSignedJWT(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := b.jwks.key(ctx, config.jwksURL(), header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims idTokenClaims
+	if err := token.Claims(key, &claims); err != nil {
+		return nil, fmt.Errorf("error verifying ID token: %s", err)
+	}
+
+	if !stringInSlice(claims.Issuer, googleIssuers) {
+		return nil, fmt.Errorf("unexpected ID token issuer: %s", claims.Issuer)
+	}
+
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, jwtLeeway); err != nil {
+		return nil, fmt.Errorf("error validating ID token: %s", err)
+	}
+
+	if claims.Expiry == nil {
+		return nil, errors.New("ID token has no expiry")
+	}
+
+	if err := validateAudience(config, claims.Audience); err != nil {
+		return nil, err
+	}
+
+	if claims.Email == "" {
+		return nil, errors.New("ID token has no email claim")
+	}
+
+	if !claims.EmailVerified {
+		return nil, errors.New("email of ID token is not verified")
+	}
+
+	if claims.HostedDomain == "" {
+		return nil, errors.New("ID token is not issued for a G Suite account")
+	}
+
+	return &goauth.Userinfoplus{
+		Id:            claims.Subject,
+		Email:         claims.Email,
+		VerifiedEmail: googleapi.Bool(true),
+		Hd:            claims.HostedDomain,
+		GivenName:     claims.GivenName,
+		FamilyName:    claims.FamilyName,
+	}, nil
+}
+
+// parseSignedJWT parses a JWT with a single RS256 signature
+func parseSignedJWT(rawToken string) (*jwt.JSONWebToken, *jose.Header, error) {
+	token, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing ID token: %s", err)
+	}
+
+	if len(token.Headers) != 1 {
+		return nil, nil, errors.New("ID token must have exactly one signature")
+	}
+	header := token.Headers[0]
+	if header.Algorithm != string(jose.RS256) {
+		return nil, nil, fmt.Errorf("unsupported ID token signing algorithm: %s", header.Algorithm)
+	}
+
+	return token, &header, nil
+}
+
+// validateAudience checks one of the audiences is accepted by the config
+func validateAudience(config *config, audience jwt.Audience) error {
+	audiences := config.jwtAudiences()
+	if len(audiences) == 0 {
+		return errors.New("no audiences configured for ID tokens")
+	}
+	for _, aud := range audience {
+		if stringInSlice(aud, audiences) {
+			return nil
+		}
+	}
+	return errors.New("ID token audience is not allowed")
+}
@@ -0,0 +1,241 @@
+package google
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2"
+)
+
+const (
+	keyringEntry      = "keyring"
+	keyringRotatePath = "keyring/rotate"
+
+	keyVersionResponsePropertyName = "key_version"
+
+	// prefix of encrypted tokens, followed by the key version and the
+	// base64 encoded nonce and ciphertext
+	tokenEnvelopePrefix = "enc:v1:"
+
+	// additional data authenticated with every encrypted token
+	tokenAdditionalData = "google-oauth2-token"
+)
+
+type keyringKey struct {
+	Version int       `json:"version"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// keyring holds the keys to encrypt the Google tokens kept by Vault, old
+// keys are kept to decrypt tokens of previous logins
+type keyring struct {
+	CurrentVersion int           `json:"current_version"`
+	Keys           []*keyringKey `json:"keys"`
+}
+
+func (k *keyring) key(version int) *keyringKey {
+	for _, key := range k.Keys {
+		if key.Version == version {
+			return key
+		}
+	}
+	return nil
+}
+
+// rotate adds a new key and makes it the current one
+func (k *keyring) rotate() error {
+	keyBytes, err := uuid.GenerateRandomBytes(32)
+	if err != nil {
+		return err
+	}
+
+	k.CurrentVersion++
+	k.Keys = append(k.Keys, &keyringKey{
+		Version: k.CurrentVersion,
+		Key:     keyBytes,
+		Created: time.Now(),
+	})
+	return nil
+}
+
+// keyringCache keeps the keyring in memory, it's invalidated when the
+// keyring is changed on another node
+type keyringCache struct {
+	lock    sync.Mutex
+	keyring *keyring
+}
+
+func (c *keyringCache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keyring = nil
+}
+
+// keyring returns the stored keyring, a keyring with a single key is created
+// if none exists
+func (b *backend) keyring(ctx context.Context, s logical.Storage) (*keyring, error) {
+	b.keyringCache.lock.Lock()
+	defer b.keyringCache.lock.Unlock()
+
+	if b.keyringCache.keyring != nil {
+		return b.keyringCache.keyring, nil
+	}
+
+	entry, err := s.Get(ctx, keyringEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{}
+	if entry != nil {
+		if err := entry.DecodeJSON(k); err != nil {
+			return nil, fmt.Errorf("error reading keyring: %s", err)
+		}
+	} else {
+		if err := k.rotate(); err != nil {
+			return nil, err
+		}
+		if err := putKeyring(ctx, s, k); err != nil {
+			return nil, err
+		}
+	}
+
+	b.keyringCache.keyring = k
+	return k, nil
+}
+
+func putKeyring(ctx context.Context, s logical.Storage, k *keyring) error {
+	entry, err := logical.StorageEntryJSON(keyringEntry, k)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// rotate the key used to encrypt tokens
+func (b *backend) pathKeyringRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// ensure the keyring exists
+	if _, err := b.keyring(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+
+	b.keyringCache.lock.Lock()
+	defer b.keyringCache.lock.Unlock()
+
+	// work on a copy, so a failed write doesn't change the cached keyring
+	k := &keyring{
+		CurrentVersion: b.keyringCache.keyring.CurrentVersion,
+		Keys:           append([]*keyringKey{}, b.keyringCache.keyring.Keys...),
+	}
+	if err := k.rotate(); err != nil {
+		return nil, err
+	}
+	if err := putKeyring(ctx, req.Storage, k); err != nil {
+		return nil, err
+	}
+	b.keyringCache.keyring = k
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			keyVersionResponsePropertyName: k.CurrentVersion,
+		},
+	}, nil
+}
+
+// encryptToken encrypts the token with the current key of the keyring
+func (b *backend) encryptToken(ctx context.Context, s logical.Storage, token *oauth2.Token) (string, error) {
+	plaintext, err := encodeToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	k, err := b.keyring(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	key := k.key(k.CurrentVersion)
+	if key == nil {
+		return "", errors.New("current key of the keyring not found")
+	}
+
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := uuid.GenerateRandomBytes(aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(tokenAdditionalData))
+
+	return fmt.Sprintf("%s%d:%s", tokenEnvelopePrefix, key.Version, base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+// decryptToken decrypts a token encrypted by encryptToken, tokens of logins
+// before encryption was introduced are decoded as is
+func (b *backend) decryptToken(ctx context.Context, s logical.Storage, encoded string) (*oauth2.Token, error) {
+	if !strings.HasPrefix(encoded, tokenEnvelopePrefix) {
+		return decodeToken(encoded)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(encoded, tokenEnvelopePrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed encrypted token")
+	}
+
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed key version of encrypted token")
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed encrypted token")
+	}
+
+	k, err := b.keyring(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	key := k.key(version)
+	if key == nil {
+		return nil, fmt.Errorf("key version %d of encrypted token not found", version)
+	}
+
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted token")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(tokenAdditionalData))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting token: %s", err)
+	}
+
+	return decodeToken(string(plaintext))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
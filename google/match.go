@@ -0,0 +1,116 @@
+package google
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// prefix of entries matched as glob, * matches any characters and ? a
+	// single one
+	globPatternPrefix = "glob:"
+
+	// prefix of entries matched as regular expression
+	regexPatternPrefix = "re:"
+)
+
+// pattern matches a value case-insensitively. Entries without prefix are
+// compared exactly, glob and regular expression entries need to match the
+// whole value.
+type pattern struct {
+	raw   string
+	exact string
+	re    *regexp.Regexp
+}
+
+func isPattern(value string) bool {
+	return strings.HasPrefix(value, globPatternPrefix) || strings.HasPrefix(value, regexPatternPrefix)
+}
+
+func compilePattern(value string) (*pattern, error) {
+	var expr string
+	switch {
+	case strings.HasPrefix(value, globPatternPrefix):
+		expr = globToRegexp(strings.TrimPrefix(value, globPatternPrefix))
+	case strings.HasPrefix(value, regexPatternPrefix):
+		expr = strings.TrimPrefix(value, regexPatternPrefix)
+	default:
+		return &pattern{raw: value, exact: strings.ToLower(value)}, nil
+	}
+
+	re, err := regexp.Compile(`(?i)^(?:` + expr + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %s", value, err)
+	}
+	return &pattern{raw: value, re: re}, nil
+}
+
+// globToRegexp converts a glob into a regular expression
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return expr.String()
+}
+
+func (p *pattern) match(value string) bool {
+	if p.re != nil {
+		return p.re.MatchString(value)
+	}
+	return p.exact == strings.ToLower(value)
+}
+
+type patterns []*pattern
+
+func compilePatterns(values []string) (patterns, error) {
+	result := make(patterns, 0, len(values))
+	for _, value := range values {
+		p, err := compilePattern(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// find returns the first pattern matching the value, nil if none matches
+func (ps patterns) find(value string) *pattern {
+	for _, p := range ps {
+		if p.match(value) {
+			return p
+		}
+	}
+	return nil
+}
+
+// findAny returns the first pattern matching any of the values and the
+// matched value
+func (ps patterns) findAny(values []string) (*pattern, string) {
+	for _, value := range values {
+		if p := ps.find(value); p != nil {
+			return p, value
+		}
+	}
+	return nil, ""
+}
+
+// match returns if any pattern matches the value
+func (ps patterns) match(value string) bool {
+	return ps.find(value) != nil
+}
+
+// matchAny returns if any pattern matches any of the values
+func (ps patterns) matchAny(values []string) bool {
+	p, _ := ps.findAny(values)
+	return p != nil
+}
@@ -8,8 +8,8 @@ import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
 	oauth2 "golang.org/x/oauth2"
-	v1 "google.golang.org/api/admin/directory/v1"
-	v2 "google.golang.org/api/oauth2/v2"
+	admin "google.golang.org/api/admin/directory/v1"
+	oauth20 "google.golang.org/api/oauth2/v2"
 	reflect "reflect"
 )
 
@@ -37,29 +37,82 @@ func (m *MockUserProvider) EXPECT() *MockUserProviderMockRecorder {
 }
 
 // authUser mocks base method
-func (m *MockUserProvider) authUser(ctx context.Context, config *oauth2.Config, token *oauth2.Token) (*v2.Userinfoplus, error) {
-	ret := m.ctrl.Call(m, "authUser", ctx, config, token)
-	ret0, _ := ret[0].(*v2.Userinfoplus)
+func (m *MockUserProvider) authUser(ctx context.Context, config *oauth2.Config, userinfoURL string, token *oauth2.Token) (*oauth20.Userinfoplus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "authUser", ctx, config, userinfoURL, token)
+	ret0, _ := ret[0].(*oauth20.Userinfoplus)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // authUser indicates an expected call of authUser
-func (mr *MockUserProviderMockRecorder) authUser(ctx, config, token interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "authUser", reflect.TypeOf((*MockUserProvider)(nil).authUser), ctx, config, token)
+func (mr *MockUserProviderMockRecorder) authUser(ctx, config, userinfoURL, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "authUser", reflect.TypeOf((*MockUserProvider)(nil).authUser), ctx, config, userinfoURL, token)
 }
 
 // oauth2Exchange mocks base method
-func (m *MockUserProvider) oauth2Exchange(ctx context.Context, code string, config *oauth2.Config) (*oauth2.Token, error) {
-	ret := m.ctrl.Call(m, "oauth2Exchange", ctx, code, config)
+func (m *MockUserProvider) oauth2Exchange(ctx context.Context, code string, config *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{ctx, code, config}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "oauth2Exchange", varargs...)
 	ret0, _ := ret[0].(*oauth2.Token)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // oauth2Exchange indicates an expected call of oauth2Exchange
-func (mr *MockUserProviderMockRecorder) oauth2Exchange(ctx, code, config interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "oauth2Exchange", reflect.TypeOf((*MockUserProvider)(nil).oauth2Exchange), ctx, code, config)
+func (mr *MockUserProviderMockRecorder) oauth2Exchange(ctx, code, config interface{}, opts ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{ctx, code, config}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "oauth2Exchange", reflect.TypeOf((*MockUserProvider)(nil).oauth2Exchange), varargs...)
+}
+
+// deviceAuth mocks base method
+func (m *MockUserProvider) deviceAuth(ctx context.Context, config *oauth2.Config, deviceAuthURL string) (*deviceAuth, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "deviceAuth", ctx, config, deviceAuthURL)
+	ret0, _ := ret[0].(*deviceAuth)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// deviceAuth indicates an expected call of deviceAuth
+func (mr *MockUserProviderMockRecorder) deviceAuth(ctx, config, deviceAuthURL interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "deviceAuth", reflect.TypeOf((*MockUserProvider)(nil).deviceAuth), ctx, config, deviceAuthURL)
+}
+
+// deviceToken mocks base method
+func (m *MockUserProvider) deviceToken(ctx context.Context, config *oauth2.Config, deviceCode string) (*oauth2.Token, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "deviceToken", ctx, config, deviceCode)
+	ret0, _ := ret[0].(*oauth2.Token)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// deviceToken indicates an expected call of deviceToken
+func (mr *MockUserProviderMockRecorder) deviceToken(ctx, config, deviceCode interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "deviceToken", reflect.TypeOf((*MockUserProvider)(nil).deviceToken), ctx, config, deviceCode)
+}
+
+// revokeToken mocks base method
+func (m *MockUserProvider) revokeToken(ctx context.Context, revocationURL, token string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "revokeToken", ctx, revocationURL, token)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// revokeToken indicates an expected call of revokeToken
+func (mr *MockUserProviderMockRecorder) revokeToken(ctx, revocationURL, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "revokeToken", reflect.TypeOf((*MockUserProvider)(nil).revokeToken), ctx, revocationURL, token)
 }
 
 // MockGroupsProvider is a mock of GroupsProvider interface
@@ -86,14 +139,89 @@ func (m *MockGroupsProvider) EXPECT() *MockGroupsProviderMockRecorder {
 }
 
 // groupsPerUser mocks base method
-func (m *MockGroupsProvider) groupsPerUser(ctx context.Context, config *config, userKey string) ([]*v1.Group, error) {
+func (m *MockGroupsProvider) groupsPerUser(ctx context.Context, config *config, userKey string) ([]*admin.Group, error) {
+	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "groupsPerUser", ctx, config, userKey)
-	ret0, _ := ret[0].([]*v1.Group)
+	ret0, _ := ret[0].([]*admin.Group)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // groupsPerUser indicates an expected call of groupsPerUser
 func (mr *MockGroupsProviderMockRecorder) groupsPerUser(ctx, config, userKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "groupsPerUser", reflect.TypeOf((*MockGroupsProvider)(nil).groupsPerUser), ctx, config, userKey)
 }
+
+// MockclientResetter is a mock of clientResetter interface
+type MockclientResetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockclientResetterMockRecorder
+}
+
+// MockclientResetterMockRecorder is the mock recorder for MockclientResetter
+type MockclientResetterMockRecorder struct {
+	mock *MockclientResetter
+}
+
+// NewMockclientResetter creates a new mock instance
+func NewMockclientResetter(ctrl *gomock.Controller) *MockclientResetter {
+	mock := &MockclientResetter{ctrl: ctrl}
+	mock.recorder = &MockclientResetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockclientResetter) EXPECT() *MockclientResetterMockRecorder {
+	return m.recorder
+}
+
+// resetClients mocks base method
+func (m *MockclientResetter) resetClients() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "resetClients")
+}
+
+// resetClients indicates an expected call of resetClients
+func (mr *MockclientResetterMockRecorder) resetClients() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "resetClients", reflect.TypeOf((*MockclientResetter)(nil).resetClients))
+}
+
+// MockAccountProvider is a mock of AccountProvider interface
+type MockAccountProvider struct {
+	ctrl     *gomock.Controller
+	recorder *MockAccountProviderMockRecorder
+}
+
+// MockAccountProviderMockRecorder is the mock recorder for MockAccountProvider
+type MockAccountProviderMockRecorder struct {
+	mock *MockAccountProvider
+}
+
+// NewMockAccountProvider creates a new mock instance
+func NewMockAccountProvider(ctrl *gomock.Controller) *MockAccountProvider {
+	mock := &MockAccountProvider{ctrl: ctrl}
+	mock.recorder = &MockAccountProviderMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockAccountProvider) EXPECT() *MockAccountProviderMockRecorder {
+	return m.recorder
+}
+
+// lookupUser mocks base method
+func (m *MockAccountProvider) lookupUser(ctx context.Context, config *config, userKey string) (*admin.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "lookupUser", ctx, config, userKey)
+	ret0, _ := ret[0].(*admin.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// lookupUser indicates an expected call of lookupUser
+func (mr *MockAccountProviderMockRecorder) lookupUser(ctx, config, userKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "lookupUser", reflect.TypeOf((*MockAccountProvider)(nil).lookupUser), ctx, config, userKey)
+}
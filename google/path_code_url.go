@@ -3,12 +3,15 @@ package google
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/go-uuid"
-	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
 	"golang.org/x/oauth2"
 )
 
@@ -16,13 +19,16 @@ const (
 	webCodeURLPath              = "web_code_url"
 	cliCodeURLPath              = "cli_code_url"
 	codeURLResponsePropertyName = "url"
+	redirectURIParameterName    = "redirect_uri"
 	typeWeb                     = "web"
 	typeCLI                     = "cli"
 )
 
 type state struct {
-	Type    string    `json:"type"` // web or cli
-	Created time.Time `json:"created"`
+	Type         string    `json:"type"` // web or cli
+	Created      time.Time `json:"created"`
+	CodeVerifier string    `json:"code_verifier"`
+	RedirectURI  string    `json:"redirect_uri"`
 }
 
 func (b *backend) statePath(stateValue string) string {
@@ -38,6 +44,8 @@ func (b *backend) cleanupStates(ctx context.Context, req *logical.Request) error
 	deadline := time.Now().Add(-24 * time.Hour)
 
 	for _, statePath := range statePaths {
+		statePath = b.statePath(statePath)
+
 		state, err := b.state(ctx, req, statePath)
 		if err != nil {
 			return err
@@ -104,33 +112,67 @@ func (b *backend) pathCodeURL(ctx context.Context, req *logical.Request, data *f
 	errUnknown := fmt.Errorf("unknown auth type: %s", authType)
 
 	var oauth2Options = []oauth2.AuthCodeOption{oauth2.ApprovalForce}
+	var redirectURI string
 	switch authType {
 	case typeWeb:
-		if config.WebClientID == "" || config.WebClientSecret == "" || config.WebRedirectURL == "" {
+		if config.WebClientID == "" || config.WebClientSecret == "" || (config.WebRedirectURL == "" && config.WebRedirectURLTemplate == "") {
 			return logical.ErrorResponse("missing config for web oauth2 client"), nil
 		}
+		redirectURI = config.webRedirectURL(req.MountPoint)
 	case typeCLI:
 		if config.CLIClientID == "" || config.CLIClientSecret == "" {
 			return logical.ErrorResponse("missing config for CLI oauth2 client"), nil
 		}
 		oauth2Options = append(oauth2Options, oauth2.AccessTypeOffline)
+
+		// redirect to a listener of the CLI instead of the out-of-band page
+		if value, ok := data.GetOk(redirectURIParameterName); ok {
+			redirectURI = value.(string)
+			if err := validateLoopbackRedirectURI(redirectURI); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
 	default:
 		return nil, errUnknown
 	}
 
 	oauth2Config := config.oauth2Config(authType)
+	if redirectURI != "" {
+		oauth2Config.RedirectURL = redirectURI
+	}
 
 	stateNonceByte, err := uuid.GenerateRandomBytes(16)
 	if err != nil {
 		return nil, err
 	}
 	stateNonce := base64.URLEncoding.EncodeToString(stateNonceByte)
+
+	// PKCE code verifier, only the challenge is part of the URL. The verifier
+	// is recovered from the state, so the challenge is only used if the login
+	// needs to supply the state: web logins, loopback redirects and configs
+	// requiring PKCE.
+	var codeVerifier string
+	if authType == typeWeb || redirectURI != "" || config.RequirePKCE {
+		codeVerifierByte, err := uuid.GenerateRandomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		codeVerifier = base64.RawURLEncoding.EncodeToString(codeVerifierByte)
+		oauth2Options = append(
+			oauth2Options,
+			oauth2.SetAuthURLParam("code_challenge", pkceChallenge(codeVerifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
 	stateObj := &state{
-		Created: time.Now(),
-		Type:    authType,
+		Created:      time.Now(),
+		Type:         authType,
+		CodeVerifier: codeVerifier,
+		RedirectURI:  redirectURI,
 	}
 
-	entry, err := logical.StorageEntryJSON(fmt.Sprintf("state/%s", stateNonce), stateObj)
+	entry, err := logical.StorageEntryJSON(b.statePath(stateNonce), stateObj)
 	if err != nil {
 		return nil, err
 	}
@@ -148,3 +190,33 @@ func (b *backend) pathCodeURL(ctx context.Context, req *logical.Request, data *f
 		},
 	}, nil
 }
+
+// validateLoopbackRedirectURI ensures the redirect URI points to a port on the
+// loopback interface of the machine running the browser.
+func validateLoopbackRedirectURI(redirectURI string) error {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return fmt.Errorf("invalid redirect_uri: %s", err)
+	}
+
+	if u.Scheme != "http" {
+		return errors.New("redirect_uri must use the http scheme")
+	}
+
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return errors.New("redirect_uri must not contain user info, query or fragment")
+	}
+
+	switch u.Hostname() {
+	case "127.0.0.1", "::1", "localhost":
+	default:
+		return errors.New("redirect_uri must point to 127.0.0.1, [::1] or localhost")
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("redirect_uri must contain a valid port")
+	}
+
+	return nil
+}
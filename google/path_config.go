@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"net/url"
 	"path"
-	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -14,28 +14,75 @@ import (
 	"google.golang.org/api/admin/directory/v1"
 	goauth "google.golang.org/api/oauth2/v2"
 
-	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const (
 	configPath  = "config"
 	configEntry = "config"
 
-	cliClientIDConfigPropertyName                = "cli_client_id"
-	cliClientSecretConfigPropertyName            = "cli_client_secret"
-	cliTTLConfigPropertyName                     = "cli_ttl"
-	cliMaxTTLConfigPropertyName                  = "cli_max_ttl"
-	webClientIDConfigPropertyName                = "web_client_id"
-	webClientSecretConfigPropertyName            = "web_client_secret"
-	webRedirectURLConfigPropertyName             = "web_redirect_url"
-	webTTLConfigPropertyName                     = "web_ttl"
-	webMaxTTLConfigPropertyName                  = "web_max_ttl"
-	directoryServiceAccountKeyConfigPropertyName = "directory_service_account_key"
-	directoryImpersonateUserConfigPropertyName   = "directory_impersonate_user"
-	allowedUsersConfigPropertyName               = "allowed_users"
-	allowedGroupsConfigPropertyName              = "allowed_groups"
-	allowedDomainsConfigPropertyName             = "allowed_domains"
+	// placeholder for the mount path in the web redirect URL template
+	mountPlaceholder = "{{mount}}"
+
+	// redirect URL of the CLI oauth2 flow, which shows the code to the user
+	cliRedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+
+	// path of the Vault UI the web login redirects to, followed by the mount
+	// path
+	webCallbackPath = "ui/vault/auth/google/callback"
+
+	// placeholder for the email in the service account JWKS URL
+	emailPlaceholder = "{{email}}"
+
+	cliClientIDConfigPropertyName                  = "cli_client_id"
+	cliClientSecretConfigPropertyName              = "cli_client_secret"
+	cliTTLConfigPropertyName                       = "cli_ttl"
+	cliMaxTTLConfigPropertyName                    = "cli_max_ttl"
+	deviceClientIDConfigPropertyName               = "device_client_id"
+	deviceClientSecretConfigPropertyName           = "device_client_secret"
+	webClientIDConfigPropertyName                  = "web_client_id"
+	webClientSecretConfigPropertyName              = "web_client_secret"
+	webRedirectURLConfigPropertyName               = "web_redirect_url"
+	webRedirectURLTemplateConfigPropertyName       = "web_redirect_url_template"
+	webTTLConfigPropertyName                       = "web_ttl"
+	webMaxTTLConfigPropertyName                    = "web_max_ttl"
+	directoryServiceAccountKeyConfigPropertyName   = "directory_service_account_key"
+	directoryImpersonateUserConfigPropertyName     = "directory_impersonate_user"
+	directoryServiceAccountEmailConfigPropertyName = "directory_service_account_email"
+	directoryCredentialSourceResponsePropertyName  = "directory_credential_source"
+	allowedUsersConfigPropertyName                 = "allowed_users"
+	allowedGroupsConfigPropertyName                = "allowed_groups"
+	allowedDomainsConfigPropertyName               = "allowed_domains"
+	allowedOrgUnitsConfigPropertyName              = "allowed_org_units"
+	deniedUsersConfigPropertyName                  = "denied_users"
+	deniedGroupsConfigPropertyName                 = "denied_groups"
+	deniedDomainsConfigPropertyName                = "denied_domains"
+	defaultRoleConfigPropertyName                  = "default_role"
+	requirePKCEConfigPropertyName                  = "require_pkce"
+	jwksURLConfigPropertyName                      = "jwks_url"
+	jwtAudiencesConfigPropertyName                 = "jwt_audiences"
+	serviceAccountJWKSURLConfigPropertyName        = "service_account_jwks_url"
+	groupsCacheTTLConfigPropertyName               = "groups_cache_ttl"
+	groupsCacheNegativeTTLConfigPropertyName       = "groups_cache_negative_ttl"
+	groupsCacheStorageConfigPropertyName           = "groups_cache_storage"
+	groupsTransitiveConfigPropertyName             = "groups_transitive"
+	groupsMaxDepthConfigPropertyName               = "groups_max_depth"
+	groupsLookupFailureModeConfigPropertyName      = "groups_lookup_failure_mode"
+	groupsProviderConfigPropertyName               = "groups_provider"
+	validateAccountStatusConfigPropertyName        = "validate_account_status"
+	require2SVConfigPropertyName                   = "require_2sv"
+	revocationURLConfigPropertyName                = "revocation_url"
+	disableTokenRevocationConfigPropertyName       = "disable_token_revocation"
+	authURLConfigPropertyName                      = "auth_url"
+	tokenURLConfigPropertyName                     = "token_url"
+	deviceAuthURLConfigPropertyName                = "device_auth_url"
+	userinfoURLConfigPropertyName                  = "userinfo_url"
+	directoryURLConfigPropertyName                 = "directory_url"
+	cloudIdentityURLConfigPropertyName             = "cloudidentity_url"
+	iamCredentialsURLConfigPropertyName            = "iam_credentials_url"
+
+	removeFieldsParameterName = "remove_fields"
 )
 
 func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -50,16 +97,40 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, dat
 		return logical.ErrorResponse(err.Error()), nil
 	}
 
+	removed, err := config.remove(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	changed = changed || removed
+
+	if err := config.validate(b.System().MaxLeaseTTL()); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
 	if !changed {
 		return nil, nil
 	}
 
+	return nil, b.putConfig(ctx, req.Storage, config)
+}
+
+// putConfig stores the config and purges the data derived from the previous
+// one
+func (b *backend) putConfig(ctx context.Context, s logical.Storage, config *config) error {
 	entry, err := logical.StorageEntryJSON(configEntry, config)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return nil, req.Storage.Put(ctx, entry)
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	b.accessPatternsCache.flush()
+
+	// cached groups might have been looked up with a different directory
+	// config
+	return b.groupsCache.purge(ctx, s)
 }
 
 func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -68,11 +139,29 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data
 		return nil, err
 	}
 
+	output := config.mapWithoutSecrets()
+	output[directoryCredentialSourceResponsePropertyName] = config.credentialSource()
+
 	return &logical.Response{
-		Data: config.mapWithoutSecrets(),
+		Data: output,
 	}, nil
 }
 
+// pathConfigDelete wipes the config, along with everything derived from it
+func (b *backend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, configEntry); err != nil {
+		return nil, err
+	}
+
+	if err := b.groupsCache.purge(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	b.accessPatternsCache.flush()
+	b.resetClients()
+
+	return nil, nil
+}
+
 // Config returns the configuration for this backend.
 func (b *backend) config(ctx context.Context, s logical.Storage) (*config, error) {
 	entry, err := s.Get(ctx, configEntry)
@@ -88,6 +177,12 @@ func (b *backend) config(ctx context.Context, s logical.Storage) (*config, error
 		return nil, fmt.Errorf("error reading configuration: %s", err)
 	}
 
+	// patterns are compiled once per stored config, invalid patterns are
+	// rejected on writes and deny every login
+	if access, err := b.accessPatternsCache.get(&result); err == nil {
+		result.access = access
+	}
+
 	/*
 		result.WebTTL /= time.Second
 		result.WebMaxTTL /= time.Second
@@ -99,155 +194,112 @@ func (b *backend) config(ctx context.Context, s logical.Storage) (*config, error
 }
 
 type config struct {
-	CLIClientID                string        `json:"cli_client_id" description:"Google application ID for CLI oauth2"`
-	CLIClientSecret            string        `json:"cli_client_secret" secret:"true" description:"Google application secret for CLI oauth2"`
-	CLITTL                     time.Duration `json:"cli_ttl" description:"Duration after which CLI authentication will be expired"`
-	CLIMaxTTL                  time.Duration `json:"cli_max_ttl" description:"Maximum duration after which CLI authentication will be expired"`
-	WebClientID                string        `json:"web_client_id" description:"Google application ID for Web oauth2"`
-	WebClientSecret            string        `json:"web_client_secret" secret:"true" description:"Google application secret for Web oauth2"`
-	WebRedirectURL             string        `json:"web_redirect_url" description:"Google redirect URL for Web oauth2"`
-	WebTTL                     time.Duration `json:"web_ttl" description:"Duration after which web authentication will be expired"`
-	WebMaxTTL                  time.Duration `json:"web_max_ttl" description:"Maximum duration after web which authentication will be expired"`
-	DirectoryServiceAccounyKey string        `json:"directory_service_account_key" secret:"true" description:"Google Service Account for Directory Group lookups"`
-	DirectoryImpersonateUser   string        `json:"directory_impersonate_user" description:"Google Admin User to Impersonate for Directory Group lookups"`
-	AllowedUsers               []string      `json:"allowed_users"`
-	AllowedGroups              []string      `json:"allowed_groups"`
-	AllowedDomains             []string      `json:"allowed_domains"`
+	CLIClientID                  string        `json:"cli_client_id" description:"Google application ID for CLI oauth2"`
+	CLIClientSecret              string        `json:"cli_client_secret" secret:"true" description:"Google application secret for CLI oauth2"`
+	CLITTL                       time.Duration `json:"cli_ttl" description:"Duration after which CLI authentication will be expired"`
+	CLIMaxTTL                    time.Duration `json:"cli_max_ttl" description:"Maximum duration after which CLI authentication will be expired"`
+	DeviceClientID               string        `json:"device_client_id" description:"Google application ID for device oauth2, needs to be of type TVs and Limited Input devices"`
+	DeviceClientSecret           string        `json:"device_client_secret" secret:"true" description:"Google application secret for device oauth2"`
+	WebClientID                  string        `json:"web_client_id" description:"Google application ID for Web oauth2"`
+	WebClientSecret              string        `json:"web_client_secret" secret:"true" description:"Google application secret for Web oauth2"`
+	WebRedirectURL               string        `json:"web_redirect_url" description:"Google redirect URL for Web oauth2"`
+	WebRedirectURLTemplate       string        `json:"web_redirect_url_template" description:"Custom redirect URL for Web oauth2, {{mount}} is replaced by the mount path. Overrides web_redirect_url"`
+	WebTTL                       time.Duration `json:"web_ttl" description:"Duration after which web authentication will be expired"`
+	WebMaxTTL                    time.Duration `json:"web_max_ttl" description:"Maximum duration after web which authentication will be expired"`
+	DirectoryServiceAccounyKey   string        `json:"directory_service_account_key" secret:"true" description:"Google Service Account for Directory Group lookups"`
+	DirectoryImpersonateUser     string        `json:"directory_impersonate_user" description:"Google Admin User to Impersonate for Directory Group lookups"`
+	DirectoryServiceAccountEmail string        `json:"directory_service_account_email" description:"Google Service Account used for Directory Group lookups without a key, its tokens are signed by the IAM Credentials API using the Application Default Credentials. Ignored if directory_service_account_key is set"`
+	AllowedUsers                 []string      `json:"allowed_users" description:"Email addresses of users allowed to login, entries prefixed with glob: or re: are matched as glob or regular expression"`
+	AllowedGroups                []string      `json:"allowed_groups" description:"Groups of users allowed to login, entries prefixed with glob: or re: are matched as glob or regular expression"`
+	AllowedDomains               []string      `json:"allowed_domains" description:"Domains of users allowed to login, entries prefixed with glob: or re: are matched as glob or regular expression"`
+	AllowedOrgUnits              []string      `json:"allowed_org_units" description:"Organizational units users need to be part of to login, in addition to matching the other allowed lists. E.g. /Engineering/SRE, which includes its sub units. Requires the directory account lookup"`
+	DeniedUsers                  []string      `json:"denied_users" description:"Email addresses of users and service accounts denied to login or renew, overrides the allowed lists. Supports glob: and re: entries"`
+	DeniedGroups                 []string      `json:"denied_groups" description:"Groups of users denied to login or renew, overrides the allowed lists. Supports glob: and re: entries"`
+	DeniedDomains                []string      `json:"denied_domains" description:"Domains of users denied to login or renew, overrides the allowed lists. Supports glob: and re: entries"`
+	DefaultRole                  string        `json:"default_role" description:"Role used for logins that don't specify a role"`
+	RequirePKCE                  bool          `json:"require_pkce" description:"Reject code logins without a state, which carries the PKCE code verifier"`
+	JWKSURL                      string        `json:"jwks_url" description:"URL of the JSON Web Key Set used to verify ID tokens, defaults to Google's"`
+	JWTAudiences                 []string      `json:"jwt_audiences" description:"Audiences accepted for ID token logins, defaults to the configured client IDs. Required for self-signed service account JWTs"`
+	ServiceAccountJWKSURL        string        `json:"service_account_jwks_url" description:"URL of the JSON Web Key Set of a service account used to verify self-signed JWTs, {{email}} is replaced by the service account. Defaults to Google's"`
+	GroupsCacheTTL               time.Duration `json:"groups_cache_ttl" description:"Duration for which the groups of a user are cached, 0 disables caching"`
+	GroupsCacheNegativeTTL       time.Duration `json:"groups_cache_negative_ttl" description:"Duration for which failed group lookups of a user are cached, 0 disables caching"`
+	GroupsCacheStorage           bool          `json:"groups_cache_storage" description:"Persist cached groups in storage, so they survive restarts and are shared with standbys"`
+	GroupsTransitive             bool          `json:"groups_transitive" description:"Resolve groups the user is a member of through other groups"`
+	GroupsMaxDepth               int           `json:"groups_max_depth" description:"Maximum nesting depth of groups resolved transitively, defaults to 5"`
+	GroupsLookupFailureMode      string        `json:"groups_lookup_failure_mode" description:"Handling of failed group lookups: allow (continue without groups), deny or cached (use the last known groups). Defaults to allow, which falls back to cached while denied_groups is set"`
+	GroupsProvider               string        `json:"groups_provider" description:"API used to look up groups: directory (Admin SDK, requires domain-wide delegation), cloudidentity (Cloud Identity Groups API, requires the Groups Reader role) or none. Defaults to directory"`
+	ValidateAccountStatus        bool          `json:"validate_account_status" description:"Look up the directory account of the user on login and renewal, deleted, suspended and archived accounts are denied"`
+	Require2SV                   bool          `json:"require_2sv" description:"Deny users not enrolled in 2-step verification, requires the directory account lookup"`
+	RevocationURL                string        `json:"revocation_url" description:"URL of the OAuth 2.0 token revocation endpoint, defaults to Google's"`
+	DisableTokenRevocation       bool          `json:"disable_token_revocation" description:"Don't revoke the Google tokens of logins once their Vault token expired"`
+	AuthURL                      string        `json:"auth_url" description:"URL of the OAuth 2.0 authorization endpoint, defaults to Google's"`
+	TokenURL                     string        `json:"token_url" description:"URL of the OAuth 2.0 token endpoint, also used to exchange the JWTs of the directory service account. Defaults to Google's"`
+	DeviceAuthURL                string        `json:"device_auth_url" description:"URL of the OAuth 2.0 device authorization endpoint, defaults to Google's"`
+	UserinfoURL                  string        `json:"userinfo_url" description:"URL of the userinfo endpoint, defaults to Google's"`
+	DirectoryURL                 string        `json:"directory_url" description:"Base URL of the Admin SDK Directory API, defaults to Google's"`
+	CloudIdentityURL             string        `json:"cloudidentity_url" description:"Base URL of the Cloud Identity API, defaults to Google's"`
+	IAMCredentialsURL            string        `json:"iam_credentials_url" description:"Base URL of the IAM Credentials API, defaults to Google's"`
+
+	// compiled allowed_* and denied_* entries, set from the
+	// accessPatternsCache when the config is loaded
+	access *accessPatterns
 }
 
-func configPathFields() map[string]*framework.FieldSchema {
-	output := make(map[string]*framework.FieldSchema)
-
-	c := &config{}
-	t := reflect.TypeOf(c).Elem()
-	v := reflect.ValueOf(c).Elem()
-	for i := 0; i < t.NumField(); i++ {
-		tagJSON := t.Field(i).Tag.Get("json")
-		tagDescription := t.Field(i).Tag.Get("description")
-
-		// skip fields without json tag
-		if tagJSON == "" {
-			continue
-		}
-
-		val := v.Field(i)
-		switch val.Type().String() {
-		case "string":
-			output[tagJSON] = &framework.FieldSchema{
-				Description: tagDescription,
-				Type:        framework.TypeString,
-			}
-		case "time.Duration":
-			output[tagJSON] = &framework.FieldSchema{
-				Description: tagDescription,
-				Type:        framework.TypeDurationSecond,
-			}
-		case "[]string":
-			output[tagJSON] = &framework.FieldSchema{
-				Description: tagDescription,
-				Type:        framework.TypeCommaStringSlice,
-			}
-		default:
-			panic(fmt.Sprintf("unknown type: %v", val.Type()))
-		}
+type accessPatterns struct {
+	allowedUsers   patterns
+	allowedGroups  patterns
+	allowedDomains patterns
+	deniedUsers    patterns
+	deniedGroups   patterns
+	deniedDomains  patterns
+}
 
+func configPathFields() map[string]*framework.FieldSchema {
+	output := structFieldSchemas(&config{})
+	output[removeFieldsParameterName] = &framework.FieldSchema{
+		Type:        framework.TypeCommaStringSlice,
+		Description: "Fields to reset to their default, e.g. allowed_groups. Fields can't be set and removed in the same request.",
 	}
-
 	return output
 }
 
 func (c *config) update(data *framework.FieldData) (changed bool, err error) {
-	t := reflect.TypeOf(c).Elem()
-	v := reflect.ValueOf(c).Elem()
-	for i := 0; i < t.NumField(); i++ {
-		tagJSON := t.Field(i).Tag.Get("json")
-
-		// skip fields without json tag
-		if tagJSON == "" {
-			continue
-		}
+	c.access = nil
+	return updateStruct(c, data)
+}
 
-		// get parameter from input data
-		param, ok := data.GetOk(tagJSON)
+// remove resets the fields listed in the remove_fields parameter
+func (c *config) remove(data *framework.FieldData) (changed bool, err error) {
+	param, ok := data.GetOk(removeFieldsParameterName)
+	if !ok {
+		return false, nil
+	}
+	fields := param.([]string)
 
-		// skip if not supplied
-		if !ok {
-			continue
+	for _, field := range fields {
+		if _, ok := data.Raw[field]; ok {
+			return false, fmt.Errorf("field '%s' can't be set and removed at the same time", field)
 		}
+	}
 
-		// update config to new value
-		val := v.Field(i)
-		switch val.Type().String() {
-		case "string":
-			s := param.(string)
-			if val.String() != s {
-				val.SetString(s)
-				changed = true
-			}
-		case "time.Duration":
-			value := time.Duration(param.(int)) * time.Second
-			if val.Int() != value.Nanoseconds() {
-				val.SetInt(value.Nanoseconds())
-				changed = true
-			}
-		case "[]string":
-			s := param.([]string)
-			if !reflect.DeepEqual(val.Interface().([]string), s) {
-				val.Set(reflect.ValueOf(s))
-				changed = true
-			}
-		default:
-			return false, fmt.Errorf("unknown type for field '%s': %v", tagJSON, val.Type())
-		}
+	c.access = nil
+	changed, err = resetStructFields(c, fields)
+	if err != nil {
+		return false, fmt.Errorf("error removing fields: %s", err)
 	}
 	return changed, nil
 }
 
 func (c *config) mapWithoutSecrets() map[string]interface{} {
-	output := make(map[string]interface{})
-
-	t := reflect.TypeOf(c).Elem()
-	v := reflect.ValueOf(c).Elem()
-	for i := 0; i < t.NumField(); i++ {
-		tagJSON := t.Field(i).Tag.Get("json")
-		tagSecret := t.Field(i).Tag.Get("secret")
-
-		// skip fields without json tag
-		if tagJSON == "" {
-			continue
-		}
-
-		secret := tagSecret == "true"
-
-		val := v.Field(i)
-
-		// if not secret, set value in map
-		if !secret {
-			if val.Type() == reflect.TypeOf(time.Duration(0)) {
-				output[tagJSON] = val.Interface().(time.Duration).String()
-			} else {
-				output[tagJSON] = val.Interface()
-			}
-			continue
-		}
-
-		// secret non empty strings should be redacted
-		switch val.Kind() {
-		case reflect.String:
-			// skip empty string
-			if val.String() == "" {
-				output[tagJSON] = ""
-			} else {
-				output[tagJSON] = "<redacted>"
-			}
-		}
-	}
-	return output
+	return structMapWithoutSecrets(c)
 }
 
 func (c *config) oauth2Config(authType string) *oauth2.Config {
 	config := &oauth2.Config{
-		Endpoint: google.Endpoint,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  c.authURL(),
+			TokenURL: c.tokenURL(),
+		},
 		Scopes: []string{
 			"https://www.googleapis.com/auth/userinfo.email",
 			"https://www.googleapis.com/auth/userinfo.profile",
@@ -257,29 +309,156 @@ func (c *config) oauth2Config(authType string) *oauth2.Config {
 	if authType == typeCLI {
 		config.ClientID = c.CLIClientID
 		config.ClientSecret = c.CLIClientSecret
-		config.RedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+		config.RedirectURL = cliRedirectURL
+	}
+
+	if authType == typeDevice {
+		config.ClientID = c.DeviceClientID
+		config.ClientSecret = c.DeviceClientSecret
 	}
 
 	if authType == typeWeb {
 		config.ClientID = c.WebClientID
 		config.ClientSecret = c.WebClientSecret
+	}
 
-		// build redirect URL
-		redirectURL, err := url.Parse(c.WebRedirectURL)
-		if err != nil {
-			redirectURL = &url.URL{Host: "localhost:8200", Scheme: "http"}
+	return config
+}
+
+// webRedirectURL returns the redirect URL of the web oauth2 flow for the
+// mount point of the request.
+func (c *config) webRedirectURL(mountPoint string) string {
+	mountPath := mountPath(mountPoint)
+
+	if c.WebRedirectURLTemplate != "" {
+		return strings.Replace(c.WebRedirectURLTemplate, mountPlaceholder, mountPath, -1)
+	}
+
+	// build redirect URL
+	redirectURL, err := url.Parse(c.WebRedirectURL)
+	if err != nil {
+		redirectURL = &url.URL{Host: "localhost:8200", Scheme: "http"}
+	}
+	redirectURL.Path = path.Join(redirectURL.Path, webCallbackPath, mountPath)
+	return redirectURL.String()
+}
+
+// mountPath returns the path the auth method is mounted at, without the auth
+// prefix
+func mountPath(mountPoint string) string {
+	mountPath := strings.Trim(strings.TrimPrefix(mountPoint, "auth/"), "/")
+	if mountPath == "" {
+		mountPath = "google"
+	}
+	return mountPath
+}
+
+func (c *config) jwksURL() string {
+	if c.JWKSURL == "" {
+		return defaultJWKSURL
+	}
+	return c.JWKSURL
+}
+
+func (c *config) revocationURL() string {
+	if c.RevocationURL == "" {
+		return defaultRevocationURL
+	}
+	return c.RevocationURL
+}
+
+func (c *config) authURL() string {
+	if c.AuthURL == "" {
+		return google.Endpoint.AuthURL
+	}
+	return c.AuthURL
+}
+
+func (c *config) tokenURL() string {
+	if c.TokenURL == "" {
+		return google.Endpoint.TokenURL
+	}
+	return c.TokenURL
+}
+
+func (c *config) deviceAuthURL() string {
+	if c.DeviceAuthURL == "" {
+		return defaultDeviceAuthURL
+	}
+	return c.DeviceAuthURL
+}
+
+func (c *config) userinfoURL() string {
+	if c.UserinfoURL == "" {
+		return defaultUserinfoURL
+	}
+	return c.UserinfoURL
+}
+
+func (c *config) directoryURL() string {
+	if c.DirectoryURL == "" {
+		return defaultDirectoryURL
+	}
+	// base URLs are joined with the paths of the API
+	return strings.TrimSuffix(c.DirectoryURL, "/") + "/"
+}
+
+func (c *config) cloudIdentityURL() string {
+	if c.CloudIdentityURL == "" {
+		return defaultCloudIdentityURL
+	}
+	return strings.TrimSuffix(c.CloudIdentityURL, "/") + "/"
+}
+
+func (c *config) iamCredentialsURL() string {
+	if c.IAMCredentialsURL == "" {
+		return defaultIAMCredentialsURL
+	}
+	return strings.TrimSuffix(c.IAMCredentialsURL, "/") + "/"
+}
+
+func (c *config) serviceAccountJWKSURL(email string) string {
+	template := c.ServiceAccountJWKSURL
+	if template == "" {
+		template = defaultServiceAccountJWKSURL
+	}
+	return strings.Replace(template, emailPlaceholder, url.PathEscape(email), -1)
+}
+
+func (c *config) jwtAudiences() []string {
+	if len(c.JWTAudiences) > 0 {
+		return c.JWTAudiences
+	}
+
+	var audiences []string
+	for _, clientID := range []string{c.CLIClientID, c.WebClientID} {
+		if clientID != "" {
+			audiences = append(audiences, clientID)
 		}
-		// TODO: support custom path
-		mountPath := "google"
-		redirectURL.Path = path.Join(redirectURL.Path, "ui/vault/auth/google/callback", mountPath)
-		config.RedirectURL = redirectURL.String()
 	}
+	return audiences
+}
 
-	return config
+func (c *config) groupsMaxDepth() int {
+	if c.GroupsMaxDepth <= 0 {
+		return defaultGroupsMaxDepth
+	}
+	return c.GroupsMaxDepth
+}
+
+// groupsLookupFailureMode returns how failed group lookups are handled. Users
+// could escape denied_groups if logins continued without groups, so the allow
+// mode falls back to the cached groups while denied groups are configured.
+func (c *config) groupsLookupFailureMode() string {
+	mode := c.GroupsLookupFailureMode
+	if (mode == "" || mode == groupsLookupFailureModeAllow) && len(c.DeniedGroups) > 0 {
+		return groupsLookupFailureModeCached
+	}
+	return mode
 }
 
 func (c *config) ttlForType(authType string) (ttl time.Duration, maxTTL time.Duration) {
-	if authType == typeCLI {
+	if authType == typeCLI || authType == typeDevice || authType == typeJWT || authType == typeServiceAccount {
 		ttl = c.CLITTL
 		maxTTL = c.CLIMaxTTL
 	}
@@ -290,46 +469,201 @@ func (c *config) ttlForType(authType string) (ttl time.Duration, maxTTL time.Dur
 	return ttl, maxTTL
 }
 
-func (c *config) authorised(user *goauth.Userinfoplus, groups []*admin.Group) bool {
+// accessPatterns returns the compiled allowed_* and denied_* entries, they
+// are compiled on first use if the config wasn't loaded from storage
+func (c *config) accessPatterns() (*accessPatterns, error) {
+	if c.access != nil {
+		return c.access, nil
+	}
+
+	access, err := compileAccessPatterns(c)
+	if err != nil {
+		return nil, err
+	}
+	c.access = access
+	return c.access, nil
+}
 
-	// base case, no restrictions configured
-	if (len(c.AllowedDomains) + len(c.AllowedGroups) + len(c.AllowedUsers)) == 0 {
-		return true
+// accessPatternsKey identifies the allowed_* and denied_* entries of the
+// config
+func (c *config) accessPatternsKey() string {
+	lists := make([]string, 0, 6)
+	for _, values := range [][]string{c.AllowedUsers, c.AllowedGroups, c.AllowedDomains, c.DeniedUsers, c.DeniedGroups, c.DeniedDomains} {
+		lists = append(lists, strings.Join(values, "\x00"))
 	}
+	return strings.Join(lists, "\x01")
+}
 
-	stringInSliceCaseInsensitive := func(s string, slice []string) bool {
-		s = strings.ToLower(s)
-		for _, elem := range slice {
-			if strings.ToLower(elem) == s {
-				return true
-			}
+func compileAccessPatterns(c *config) (*accessPatterns, error) {
+	var access accessPatterns
+	for _, field := range []struct {
+		name   string
+		values []string
+		target *patterns
+	}{
+		{allowedUsersConfigPropertyName, c.AllowedUsers, &access.allowedUsers},
+		{allowedGroupsConfigPropertyName, c.AllowedGroups, &access.allowedGroups},
+		{allowedDomainsConfigPropertyName, c.AllowedDomains, &access.allowedDomains},
+		{deniedUsersConfigPropertyName, c.DeniedUsers, &access.deniedUsers},
+		{deniedGroupsConfigPropertyName, c.DeniedGroups, &access.deniedGroups},
+		{deniedDomainsConfigPropertyName, c.DeniedDomains, &access.deniedDomains},
+	} {
+		compiled, err := compilePatterns(field.values)
+		if err != nil {
+			return nil, fmt.Errorf("%s contains an %s", field.name, err)
 		}
+		*field.target = compiled
+	}
+
+	return &access, nil
+}
+
+// accessPatternsCache keeps the patterns compiled from the stored config, so
+// they aren't compiled on every login. It's flushed whenever the config
+// changes.
+type accessPatternsCache struct {
+	lock   sync.Mutex
+	key    string
+	access *accessPatterns
+}
+
+// get returns the compiled patterns of the config, they are only compiled
+// if the entries changed
+func (c *accessPatternsCache) get(config *config) (*accessPatterns, error) {
+	key := config.accessPatternsKey()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.access != nil && c.key == key {
+		return c.access, nil
+	}
+
+	access, err := compileAccessPatterns(config)
+	if err != nil {
+		return nil, err
+	}
+	c.key = key
+	c.access = access
+	return access, nil
+}
+
+func (c *accessPatternsCache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.key = ""
+	c.access = nil
+}
+
+// denied returns if the user, its domain or one of its groups is denied,
+// which takes precedence over the allowed lists
+func (c *config) denied(user *goauth.Userinfoplus, groups []*admin.Group) bool {
+	denied, _ := c.deniedReason(user, groups)
+	return denied
+}
+
+// deniedReason is denied, which also explains the decision
+func (c *config) deniedReason(user *goauth.Userinfoplus, groups []*admin.Group) (bool, string) {
+	if (len(c.DeniedDomains) + len(c.DeniedGroups) + len(c.DeniedUsers)) == 0 {
+		return false, ""
+	}
+
+	// invalid patterns deny every user
+	access, err := c.accessPatterns()
+	if err != nil {
+		return true, err.Error()
+	}
+
+	if p := access.deniedDomains.find(user.Hd); p != nil {
+		return true, fmt.Sprintf("denied by %s entry %q", deniedDomainsConfigPropertyName, p.raw)
+	}
+	if p := access.deniedUsers.find(user.Email); p != nil {
+		return true, fmt.Sprintf("denied by %s entry %q", deniedUsersConfigPropertyName, p.raw)
+	}
+	if p, group := access.deniedGroups.findAny(groupEmails(groups)); p != nil {
+		return true, fmt.Sprintf("denied by %s entry %q for group %s", deniedGroupsConfigPropertyName, p.raw, group)
+	}
+	return false, ""
+}
+
+// deniedServiceAccount returns if the service account is listed in
+// denied_users
+func (c *config) deniedServiceAccount(sa *serviceAccount) bool {
+	if len(c.DeniedUsers) == 0 {
 		return false
 	}
 
-	// allowed by domains
-	if stringInSliceCaseInsensitive(user.Hd, c.AllowedDomains) {
+	access, err := c.accessPatterns()
+	if err != nil {
 		return true
 	}
 
-	// allowed by users
-	if stringInSliceCaseInsensitive(user.Email, c.AllowedUsers) {
-		return true
+	return access.deniedUsers.match(sa.Email)
+}
+
+func (c *config) authorised(user *goauth.Userinfoplus, account *admin.User, groups []*admin.Group) bool {
+	allowed, _ := c.authorisation(user, account, groups)
+	return allowed
+}
+
+// authorisation is authorised, which also explains the decision
+func (c *config) authorisation(user *goauth.Userinfoplus, account *admin.User, groups []*admin.Group) (bool, string) {
+	if denied, reason := c.deniedReason(user, groups); denied {
+		return false, reason
 	}
 
-	// list of groups and aliases of the user
-	userGroups := []string{}
-	for _, group := range groups {
-		userGroups = append(userGroups, group.Email)
-		userGroups = append(userGroups, group.Aliases...)
+	// org units restrict the users in addition to the other allowed lists,
+	// the account is looked up if they are configured
+	var orgUnitReason string
+	if len(c.AllowedOrgUnits) > 0 {
+		if account == nil {
+			return false, "the org unit of the user is unknown"
+		}
+		for _, orgUnit := range c.AllowedOrgUnits {
+			if orgUnitContains(orgUnit, account.OrgUnitPath) {
+				orgUnitReason = fmt.Sprintf("%s entry %q for org unit %s", allowedOrgUnitsConfigPropertyName, orgUnit, account.OrgUnitPath)
+				break
+			}
+		}
+		if orgUnitReason == "" {
+			return false, fmt.Sprintf("org unit %s is not matched by %s", account.OrgUnitPath, allowedOrgUnitsConfigPropertyName)
+		}
+	}
+	allowed := func(reason string) (bool, string) {
+		if orgUnitReason != "" {
+			reason += " and " + orgUnitReason
+		}
+		return true, reason
 	}
 
-	// check if any allowed group matches
-	for _, allowedGroup := range c.AllowedGroups {
-		if stringInSliceCaseInsensitive(allowedGroup, userGroups) {
-			return true
+	// base case, no restrictions configured
+	if (len(c.AllowedDomains) + len(c.AllowedGroups) + len(c.AllowedUsers)) == 0 {
+		if orgUnitReason != "" {
+			return true, "allowed by " + orgUnitReason
 		}
+		return true, "no allowed_users, allowed_groups, allowed_domains or allowed_org_units configured"
+	}
+
+	// invalid patterns deny every user
+	access, err := c.accessPatterns()
+	if err != nil {
+		return false, err.Error()
+	}
+
+	// allowed by domains
+	if p := access.allowedDomains.find(user.Hd); p != nil {
+		return allowed(fmt.Sprintf("allowed by %s entry %q", allowedDomainsConfigPropertyName, p.raw))
+	}
+
+	// allowed by users
+	if p := access.allowedUsers.find(user.Email); p != nil {
+		return allowed(fmt.Sprintf("allowed by %s entry %q", allowedUsersConfigPropertyName, p.raw))
+	}
+
+	// check if any allowed group matches
+	if p, group := access.allowedGroups.findAny(groupEmails(groups)); p != nil {
+		return allowed(fmt.Sprintf("allowed by %s entry %q for group %s", allowedGroupsConfigPropertyName, p.raw, group))
 	}
 
-	return false
+	return false, "not matched by allowed_users, allowed_groups or allowed_domains"
 }
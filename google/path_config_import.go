@@ -0,0 +1,200 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	configImportPath = "config/import"
+
+	clientSecretParameterName = "client_secret"
+	clientTypeParameterName   = "client_type"
+
+	clientTypeResponsePropertyName  = "client_type"
+	redirectURLResponsePropertyName = "redirect_url"
+)
+
+// clientSecretFile is the client_secret.json downloaded from the Google Cloud
+// Console, it contains either an installed or a web client
+type clientSecretFile struct {
+	Installed *clientSecret `json:"installed"`
+	Web       *clientSecret `json:"web"`
+}
+
+type clientSecret struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+func configImportPathFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		clientSecretParameterName: {
+			Type:        framework.TypeString,
+			Description: "Content of the client_secret.json downloaded from the Google Cloud Console.",
+		},
+		clientTypeParameterName: {
+			Type:        framework.TypeString,
+			Description: "Flow an installed client is used for: cli or device. Defaults to cli, web clients are always used for the web flow. Optional.",
+		},
+	}
+}
+
+// pathConfigImport sets the client of the flow matching the type of the
+// client_secret.json, the redirect URIs registered for the client are
+// checked against the ones used by the flow.
+func (b *backend) pathConfigImport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	raw := data.Get(clientSecretParameterName).(string)
+	if raw == "" {
+		return logical.ErrorResponse(fmt.Sprintf("%s is required", clientSecretParameterName)), nil
+	}
+
+	var file clientSecretFile
+	if err := json.Unmarshal([]byte(raw), &file); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error parsing %s: %s", clientSecretParameterName, err)), nil
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	clientType := data.Get(clientTypeParameterName).(string)
+
+	var client *clientSecret
+	var redirectURL string
+	var warnings []string
+	switch {
+	case file.Installed != nil && file.Web != nil:
+		return logical.ErrorResponse(fmt.Sprintf("%s must contain either an installed or a web client", clientSecretParameterName)), nil
+	case file.Installed != nil:
+		client = file.Installed
+		if clientType == "" {
+			clientType = typeCLI
+		}
+		switch clientType {
+		case typeCLI:
+			config.CLIClientID = client.ClientID
+			config.CLIClientSecret = client.ClientSecret
+
+			warning, err := checkInstalledRedirectURIs(client.RedirectURIs)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+			if warning != "" {
+				warnings = append(warnings, warning)
+			}
+			redirectURL = cliRedirectURL
+		case typeDevice:
+			config.DeviceClientID = client.ClientID
+			config.DeviceClientSecret = client.ClientSecret
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("%s of installed clients must be %s or %s", clientTypeParameterName, typeCLI, typeDevice)), nil
+		}
+	case file.Web != nil:
+		client = file.Web
+		if clientType != "" && clientType != typeWeb {
+			return logical.ErrorResponse(fmt.Sprintf("%s of web clients must be %s", clientTypeParameterName, typeWeb)), nil
+		}
+		clientType = typeWeb
+		config.WebClientID = client.ClientID
+		config.WebClientSecret = client.ClientSecret
+
+		redirectURL, err = config.importWebRedirectURL(req.MountPoint, client.RedirectURIs)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("%s contains neither an installed nor a web client", clientSecretParameterName)), nil
+	}
+
+	if client.ClientID == "" || client.ClientSecret == "" {
+		return logical.ErrorResponse(fmt.Sprintf("%s contains no client_id or client_secret", clientSecretParameterName)), nil
+	}
+
+	if err := config.validate(b.System().MaxLeaseTTL()); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := b.putConfig(ctx, req.Storage, config); err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			clientTypeResponsePropertyName: clientType,
+		},
+	}
+	if redirectURL != "" {
+		resp.Data[redirectURLResponsePropertyName] = redirectURL
+	}
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
+}
+
+// checkInstalledRedirectURIs ensures the CLI flow can redirect to one of the
+// URIs registered for an installed client. Installed clients registering a
+// loopback address only work with a redirect_uri supplied by the CLI.
+func checkInstalledRedirectURIs(redirectURIs []string) (warning string, err error) {
+	// the redirect URIs of installed clients are implicit if missing
+	if len(redirectURIs) == 0 || stringInSlice(cliRedirectURL, redirectURIs) {
+		return "", nil
+	}
+
+	for _, redirectURI := range redirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil {
+			continue
+		}
+		switch u.Hostname() {
+		case "127.0.0.1", "::1", "localhost":
+			return fmt.Sprintf("client doesn't register %s, CLI logins need to supply a loopback %s", cliRedirectURL, redirectURIParameterName), nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the redirect URIs of the client can be used by the CLI flow, register %s or http://localhost", cliRedirectURL)
+}
+
+// importWebRedirectURL finds the redirect URI registered for the web client,
+// which points to the callback of this mount. Without a redirect URL template
+// web_redirect_url is set to the base URL of that redirect URI.
+func (c *config) importWebRedirectURL(mountPoint string, redirectURIs []string) (string, error) {
+	if c.WebRedirectURLTemplate != "" {
+		redirectURL := c.webRedirectURL(mountPoint)
+		if !stringInSlice(redirectURL, redirectURIs) {
+			return "", fmt.Errorf("redirect URI %s of %s is not registered for the client", redirectURL, webRedirectURLTemplateConfigPropertyName)
+		}
+		return redirectURL, nil
+	}
+
+	suffix := "/" + webCallbackPath + "/" + mountPath(mountPoint)
+	for _, redirectURI := range redirectURIs {
+		if !strings.HasSuffix(redirectURI, suffix) {
+			continue
+		}
+
+		baseURL := strings.TrimSuffix(redirectURI, suffix)
+		candidate := &config{WebRedirectURL: baseURL}
+		if candidate.webRedirectURL(mountPoint) != redirectURI {
+			continue
+		}
+
+		c.WebRedirectURL = baseURL
+		return redirectURI, nil
+	}
+
+	if len(redirectURIs) == 0 {
+		return "", errors.New("no redirect URIs are registered for the client")
+	}
+	return "", fmt.Errorf("none of the redirect URIs of the client point to %s", strings.TrimPrefix(suffix, "/"))
+}
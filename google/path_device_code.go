@@ -0,0 +1,290 @@
+package google
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2"
+)
+
+const (
+	deviceCodePath                = "device_code"
+	deviceCodeParameterName       = "device_code"
+	userCodeResponsePropertyName  = "user_code"
+	verificationURLPropertyName   = "verification_url"
+	expiresInResponsePropertyName = "expires_in"
+	intervalResponsePropertyName  = "interval"
+	statusResponsePropertyName    = "status"
+	typeDevice                    = "device"
+
+	// interval used if the authorization server doesn't specify one
+	deviceDefaultInterval = 5 * time.Second
+)
+
+var (
+	// interval increase requested by a slow_down error
+	deviceSlowDownIncrement = 5 * time.Second
+
+	// how long a login polls for the token of a device code
+	deviceLoginMaxWait = 30 * time.Second
+)
+
+type deviceSession struct {
+	DeviceCode string        `json:"device_code"`
+	Interval   time.Duration `json:"interval"`
+	Created    time.Time     `json:"created"`
+	Expires    time.Time     `json:"expires"`
+	LastPolled time.Time     `json:"last_polled"`
+
+	// encrypted token received during an alias lookahead
+	Token string `json:"token,omitempty"`
+}
+
+func (b *backend) deviceSessionPath(sessionValue string) string {
+	return fmt.Sprintf("device/%s", sessionValue)
+}
+
+func (b *backend) deviceSession(ctx context.Context, req *logical.Request, sessionPath string) (*deviceSession, error) {
+	entry, err := req.Storage.Get(ctx, sessionPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var session = &deviceSession{}
+
+	if err := entry.DecodeJSON(session); err != nil {
+		return nil, fmt.Errorf("error reading device session: %s", err)
+	}
+
+	return session, nil
+}
+
+func (b *backend) putDeviceSession(ctx context.Context, req *logical.Request, sessionPath string, session *deviceSession) error {
+	entry, err := logical.StorageEntryJSON(sessionPath, session)
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) cleanupDeviceSessions(ctx context.Context, req *logical.Request) error {
+	sessionPaths, err := req.Storage.List(ctx, b.deviceSessionPath(""))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, sessionPath := range sessionPaths {
+		sessionPath = b.deviceSessionPath(sessionPath)
+
+		session, err := b.deviceSession(ctx, req, sessionPath)
+		if err != nil {
+			return err
+		}
+		if session == nil {
+			continue
+		}
+
+		// keep sessions which haven't expired
+		if session.Expires.After(now) {
+			continue
+		}
+
+		if err := req.Storage.Delete(ctx, sessionPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start the device flow and return the user code and verification URL
+func (b *backend) pathDeviceCode(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DeviceClientID == "" || config.DeviceClientSecret == "" {
+		return logical.ErrorResponse("missing config for device oauth2 client"), nil
+	}
+
+	auth, err := b.user.deviceAuth(ctx, config.oauth2Config(typeDevice), config.deviceAuthURL())
+	if err != nil {
+		return nil, err
+	}
+
+	sessionNonceByte, err := uuid.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	sessionNonce := base64.URLEncoding.EncodeToString(sessionNonceByte)
+
+	now := time.Now()
+	session := &deviceSession{
+		DeviceCode: auth.DeviceCode,
+		Interval:   auth.Interval,
+		Created:    now,
+		Expires:    now.Add(auth.ExpiresIn),
+	}
+	if session.Interval <= 0 {
+		session.Interval = deviceDefaultInterval
+	}
+
+	if err := b.cleanupDeviceSessions(ctx, req); err != nil {
+		return nil, err
+	}
+
+	if err := b.putDeviceSession(ctx, req, b.deviceSessionPath(sessionNonce), session); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			deviceCodeParameterName:       sessionNonce,
+			userCodeResponsePropertyName:  auth.UserCode,
+			verificationURLPropertyName:   auth.VerificationURL,
+			expiresInResponsePropertyName: int64(auth.ExpiresIn / time.Second),
+			intervalResponsePropertyName:  int64(session.Interval / time.Second),
+		},
+	}, nil
+}
+
+// devicePendingResponse asks the client to retry the login with the same
+// device code once the interval passed. It's no error response, so clients
+// can tell a pending request apart from a failed login, the status is the
+// OAuth 2.0 error code of the last poll.
+func devicePendingResponse(deviceCode string, status string, interval time.Duration) *logical.Response {
+	seconds := int64((interval + time.Second - 1) / time.Second)
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			deviceCodeParameterName:      deviceCode,
+			statusResponsePropertyName:   status,
+			intervalResponsePropertyName: seconds,
+		},
+	}
+	resp.AddWarning(fmt.Sprintf("the request hasn't been approved yet, retry with the same %s in %ds", deviceCodeParameterName, seconds))
+	return resp
+}
+
+// deviceLoginToken polls the token of the device session until the user
+// approved or denied the request. Polling stops after deviceLoginMaxWait, so
+// a login request doesn't outlast the request timeouts of Vault and its
+// clients, and the client is asked to retry. Alias lookaheads poll at most
+// once and keep the session, a token received is stored with it for the login
+// that follows.
+func (b *backend) deviceLoginToken(ctx context.Context, req *logical.Request, sessionValue string, oauth2config *oauth2.Config) (*oauth2.Token, *logical.Response, error) {
+	sessionPath := b.deviceSessionPath(sessionValue)
+
+	session, err := b.deviceSession(ctx, req, sessionPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// no matching session found
+	if session == nil {
+		return nil, logical.ErrorResponse("this device code can't be found or has already been used"), nil
+	}
+
+	lookahead := req.Operation == logical.AliasLookaheadOperation
+	deleteSession := func() error {
+		if lookahead {
+			return nil
+		}
+		return req.Storage.Delete(ctx, sessionPath)
+	}
+
+	now := time.Now()
+	if now.After(session.Expires) {
+		if err := deleteSession(); err != nil {
+			return nil, nil, err
+		}
+		return nil, logical.ErrorResponse("the device code has expired"), nil
+	}
+
+	// the request was approved during an alias lookahead
+	if session.Token != "" {
+		token, err := b.decryptToken(ctx, req.Storage, session.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := deleteSession(); err != nil {
+			return nil, nil, err
+		}
+		return token, nil, nil
+	}
+
+	deadline := now.Add(deviceLoginMaxWait)
+	if session.Expires.Before(deadline) {
+		deadline = session.Expires
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	status := "authorization_pending"
+	for polls := 0; ; polls++ {
+		// polls faster than the interval would make Google slow down the
+		// device code
+		next := session.LastPolled.Add(session.Interval)
+		wait := time.Until(next)
+		if next.After(deadline) || (lookahead && (polls > 0 || wait > 0)) {
+			return nil, devicePendingResponse(sessionValue, status, session.Interval), nil
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		token, err := b.user.deviceToken(ctx, oauth2config, session.DeviceCode)
+		if err == nil {
+			if lookahead {
+				encodedToken, err := b.encryptToken(ctx, req.Storage, token)
+				if err != nil {
+					return nil, nil, err
+				}
+				session.Token = encodedToken
+				if err := b.putDeviceSession(ctx, req, sessionPath, session); err != nil {
+					return nil, nil, err
+				}
+			} else if err := deleteSession(); err != nil {
+				return nil, nil, err
+			}
+			return token, nil, nil
+		}
+
+		oauth2Err, ok := err.(*oauth2Error)
+		if !ok {
+			return nil, nil, err
+		}
+
+		switch oauth2Err.Code {
+		case "authorization_pending", "slow_down":
+			if oauth2Err.Code == "slow_down" {
+				session.Interval += deviceSlowDownIncrement
+			}
+			status = oauth2Err.Code
+			session.LastPolled = time.Now()
+			if err := b.putDeviceSession(ctx, req, sessionPath, session); err != nil {
+				return nil, nil, err
+			}
+		default:
+			// the user denied access or the device code is no longer valid
+			if err := deleteSession(); err != nil {
+				return nil, nil, err
+			}
+			return nil, logical.ErrorResponse(fmt.Sprintf("device authorization failed: %s", oauth2Err)), nil
+		}
+	}
+}
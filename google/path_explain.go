@@ -0,0 +1,197 @@
+package google
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"google.golang.org/api/admin/directory/v1"
+	goauth "google.golang.org/api/oauth2/v2"
+)
+
+const (
+	explainPath = "explain"
+
+	emailParameterName        = "email"
+	hostedDomainParameterName = "hosted_domain"
+	typeParameterName         = "type"
+)
+
+func explainPathFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		emailParameterName: {
+			Type:        framework.TypeString,
+			Description: "Email of the user to explain the login of.",
+		},
+		hostedDomainParameterName: {
+			Type:        framework.TypeString,
+			Description: "Hosted domain of the user, defaults to the domain of the email. Optional.",
+		},
+		roleParameterName: {
+			Type:        framework.TypeString,
+			Description: "Role to explain the login with, defaults to the configured default role. Optional.",
+		},
+		typeParameterName: {
+			Type:        framework.TypeString,
+			Description: "Login method the TTLs are returned for: cli, device or web. Defaults to cli. Optional.",
+		},
+	}
+}
+
+// pathExplain evaluates a login of the user like pathLogin does, without
+// authenticating the user or issuing a token. It returns which rule allowed
+// or denied the user and what the login would result in.
+func (b *backend) pathExplain(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	email := data.Get(emailParameterName).(string)
+	if email == "" {
+		return logical.ErrorResponse(fmt.Sprintf("%s is required", emailParameterName)), nil
+	}
+
+	authType := data.Get(typeParameterName).(string)
+	if authType == "" {
+		authType = typeCLI
+	}
+	if authType != typeCLI && authType != typeDevice && authType != typeWeb {
+		return logical.ErrorResponse(fmt.Sprintf("%s must be one of %s, %s or %s", typeParameterName, typeCLI, typeDevice, typeWeb)), nil
+	}
+
+	hostedDomain, ok := data.GetOk(hostedDomainParameterName)
+	if !ok {
+		if i := strings.LastIndex(email, "@"); i >= 0 {
+			hostedDomain = email[i+1:]
+		}
+	}
+
+	user := &goauth.Userinfoplus{
+		Email: email,
+		Hd:    hostedDomain.(string),
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	roleName := data.Get(roleParameterName).(string)
+	if roleName == "" {
+		roleName = config.DefaultRole
+	}
+
+	var role *role
+	if roleName != "" {
+		role, err = b.role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		emailParameterName:        user.Email,
+		hostedDomainParameterName: user.Hd,
+		roleParameterName:         roleName,
+		typeParameterName:         authType,
+		"allowed":                 false,
+	}
+	resp := &logical.Response{Data: result}
+
+	// failed lookups are reported, the rest of the login is still explained
+	allowed := true
+
+	account, err := b.validateAccount(ctx, config, user)
+	if err != nil {
+		result["account_error"] = err.Error()
+		allowed = false
+	}
+	if account != nil {
+		result["org_unit"] = account.OrgUnitPath
+	}
+
+	groups, groupsAllowed, err := b.explainGroups(ctx, req.Storage, config, user, result)
+	if err != nil {
+		return nil, err
+	}
+	result["groups"] = groupEmails(groups)
+	allowed = allowed && groupsAllowed
+
+	// the bindings of a role replace the allowed lists of the config
+	var configAllowed bool
+	var configReason string
+	if role == nil {
+		configAllowed, configReason = config.authorisation(user, account, groups)
+	} else if denied, reason := config.deniedReason(user, groups); denied {
+		configReason = reason
+	} else {
+		configAllowed = true
+		configReason = "not denied, the allowed lists are replaced by the role bindings"
+	}
+	result["config_allowed"] = configAllowed
+	result["config_reason"] = configReason
+
+	allowed = allowed && configAllowed
+	if role != nil {
+		roleAllowed, roleReason := role.authorisation(user, groups)
+		result["role_allowed"] = roleAllowed
+		result["role_reason"] = roleReason
+		allowed = allowed && roleAllowed
+	}
+	result["allowed"] = allowed
+
+	// what a login would result in
+	auth := &logical.Auth{}
+	setGroups(auth, user, groups)
+	groupAliases := make([]string, 0, len(auth.GroupAliases))
+	for _, alias := range auth.GroupAliases {
+		groupAliases = append(groupAliases, alias.Name)
+	}
+	result["group_aliases"] = groupAliases
+
+	policies := []string{}
+	if role != nil {
+		policies = append(policies, role.Policies...)
+	}
+	result["policies"] = policies
+
+	ttl, maxTTL := role.ttls(config, authType)
+	result["ttl"] = ttl.String()
+	result["max_ttl"] = maxTTL.String()
+
+	return resp, nil
+}
+
+// explainGroups looks up the groups of the user like userGroups does, but
+// bypasses the groups cache, which is only read for the cached failure mode.
+// A failed lookup is added to the result along with how the failure mode
+// handles it.
+func (b *backend) explainGroups(ctx context.Context, s logical.Storage, config *config, user *goauth.Userinfoplus, result map[string]interface{}) ([]*admin.Group, bool, error) {
+	groups, err := b.fetchGroups(ctx, config, user.Email)
+	if err == nil {
+		return groups, true, nil
+	}
+	result["groups_error"] = err.Error()
+
+	switch config.groupsLookupFailureMode() {
+	case groupsLookupFailureModeDeny:
+		result["groups_reason"] = fmt.Sprintf("the lookup failed and %s is %s", groupsLookupFailureModeConfigPropertyName, groupsLookupFailureModeDeny)
+		return []*admin.Group{}, false, nil
+	case groupsLookupFailureModeCached:
+		item, err := b.groupsCache.get(ctx, s, config, strings.ToLower(user.Email))
+		if err != nil {
+			return nil, false, err
+		}
+		if item == nil || item.Fetched.IsZero() {
+			result["groups_reason"] = "the lookup failed and no groups of the user are cached"
+			return []*admin.Group{}, false, nil
+		}
+		result["groups_reason"] = fmt.Sprintf("the lookup failed, the groups cached at %s are used", item.Fetched.Format(time.RFC3339))
+		return item.Groups, true, nil
+	default:
+		result["groups_reason"] = "the lookup failed, the login continues without groups"
+		return []*admin.Group{}, true, nil
+	}
+}
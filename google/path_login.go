@@ -10,14 +10,17 @@ import (
 	"google.golang.org/api/admin/directory/v1"
 	goauth "google.golang.org/api/oauth2/v2"
 
-	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const (
 	loginPath                   = "login"
 	googleAuthCodeParameterName = "code"
 	stateParameterName          = "state"
+	jwtParameterName            = "jwt"
+	typeJWT                     = "jwt"
 )
 
 func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -28,10 +31,83 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *fra
 		return nil, err
 	}
 
+	roleName := data.Get(roleParameterName).(string)
+	if roleName == "" {
+		roleName = config.DefaultRole
+	}
+
+	var role *role
+	if roleName != "" {
+		role, err = b.role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+		}
+	}
+
+	// verify the ID token instead of exchanging a code if supplied
+	if rawJWT := data.Get(jwtParameterName).(string); len(rawJWT) > 0 {
+		if isServiceAccountJWT(rawJWT) {
+			sa, err := b.verifyServiceAccountJWT(ctx, config, rawJWT, roleName, role)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+
+			return b.serviceAccountLoginResponse(config, sa, roleName, role)
+		}
+
+		user, err := b.verifyIDToken(ctx, config, rawJWT)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		return b.loginResponse(ctx, req, config, user, nil, typeJWT, roleName, role)
+	}
+
+	// poll for the token of a device flow if a device code is supplied
+	if sessionValue := data.Get(deviceCodeParameterName).(string); len(sessionValue) > 0 {
+		oauth2config := config.oauth2Config(typeDevice)
+
+		token, resp, err := b.deviceLoginToken(ctx, req, sessionValue, oauth2config)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+
+		user, err := b.user.authUser(ctx, oauth2config, config.userinfoURL(), token)
+		if err != nil {
+			return nil, err
+		}
+
+		// the session is kept for the login, which follows the lookahead
+		if req.Operation == logical.AliasLookaheadOperation {
+			return &logical.Response{
+				Auth: &logical.Auth{
+					Alias: &logical.Alias{
+						Name: user.Email,
+					},
+				},
+			}, nil
+		}
+
+		return b.loginResponse(ctx, req, config, user, token, typeDevice, roleName, role)
+	}
+
 	authType := typeCLI
+	var exchangeOptions []oauth2.AuthCodeOption
+
+	var redirectURI string
 
 	// use web config if state is set
-	if stateValue := data.Get(stateParameterName).(string); len(stateValue) > 0 {
+	stateValue := data.Get(stateParameterName).(string)
+	if len(stateValue) == 0 && config.RequirePKCE {
+		return logical.ErrorResponse("a state is required to login with a code"), nil
+	}
+	if len(stateValue) == 0 && len(data.Get(redirectURIParameterName).(string)) > 0 {
+		return logical.ErrorResponse("a state is required to login with a redirect_uri"), nil
+	}
+	if len(stateValue) > 0 {
 		statePath := b.statePath(stateValue)
 
 		state, err := b.state(ctx, req, statePath)
@@ -46,6 +122,25 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *fra
 
 		authType = state.Type
 
+		// the redirect URI needs to match the one used for the code URL, web
+		// logins don't need to supply it as it's derived from the mount
+		requestedRedirectURI := data.Get(redirectURIParameterName).(string)
+		if (authType == typeCLI || requestedRedirectURI != "") && requestedRedirectURI != state.RedirectURI {
+			return logical.ErrorResponse("redirect_uri doesn't match the one of the code URL"), nil
+		}
+		redirectURI = state.RedirectURI
+
+		// states created before the redirect URI was stored
+		if authType == typeWeb && redirectURI == "" {
+			redirectURI = config.webRedirectURL(req.MountPoint)
+		}
+
+		if len(state.CodeVerifier) > 0 {
+			exchangeOptions = append(exchangeOptions, oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier))
+		} else if config.RequirePKCE {
+			return logical.ErrorResponse("this state has no PKCE code verifier"), nil
+		}
+
 		if err := b.deleteState(ctx, req, statePath); err != nil {
 			return nil, err
 		}
@@ -56,37 +151,71 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *fra
 	}
 
 	oauth2config := config.oauth2Config(authType)
+	if redirectURI != "" {
+		oauth2config.RedirectURL = redirectURI
+	}
 
-	token, err := b.user.oauth2Exchange(ctx, code, oauth2config)
+	token, err := b.user.oauth2Exchange(ctx, code, oauth2config, exchangeOptions...)
 	if err != nil {
 		return nil, err
 	}
 
-	user, groups, err := b.authenticate(ctx, config, token, authType)
+	user, err := b.user.authUser(ctx, oauth2config, config.userinfoURL(), token)
 	if err != nil {
 		return nil, err
 	}
 
-	if !config.authorised(user, groups) {
-		return logical.ErrorResponse("user is not allowed to login"), nil
+	return b.loginResponse(ctx, req, config, user, token, authType, roleName, role)
+}
+
+// loginResponse authorises the authenticated user and builds the auth
+// response. The token is only set for logins using oauth2.
+func (b *backend) loginResponse(ctx context.Context, req *logical.Request, config *config, user *goauth.Userinfoplus, token *oauth2.Token, authType string, roleName string, role *role) (*logical.Response, error) {
+	account, err := b.validateAccount(ctx, config, user)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	encodedToken, err := encodeToken(token)
+	groups, err := b.userGroups(ctx, req.Storage, config, user)
 	if err != nil {
-		return nil, err
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := authorise(config, roleName, role, user, account, groups); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	internalData := map[string]interface{}{
+		"type": authType,
+		"role": roleName,
 	}
 
-	ttl, maxTTL := config.ttlForType(authType)
+	ttl, maxTTL := role.ttls(config, authType)
+
+	if token != nil {
+		encodedToken, err := b.encryptToken(ctx, req.Storage, token)
+		if err != nil {
+			return nil, err
+		}
+		internalData["token"] = encodedToken
+
+		// track the token, so it's revoked once the login expired
+		grantID, err := b.trackGrant(ctx, req, config, user.Email, encodedToken, ttl, maxTTL)
+		if err != nil {
+			return nil, err
+		}
+		if grantID != "" {
+			internalData["grant"] = grantID
+		}
+	}
 
 	resp := &logical.Response{
 		Auth: &logical.Auth{
-			InternalData: map[string]interface{}{
-				"token": encodedToken,
-				"type":  authType,
-			},
+			InternalData: internalData,
 			Metadata: map[string]string{
 				"username": user.Email,
 				"domain":   user.Hd,
+				"role":     roleName,
 			},
 			DisplayName: user.Email,
 			LeaseOptions: logical.LeaseOptions{
@@ -106,39 +235,81 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *fra
 		},
 	}
 
+	if role != nil {
+		resp.Auth.Policies = role.Policies
+	}
+
+	if account != nil {
+		resp.Auth.Alias.Metadata["org_unit"] = account.OrgUnitPath
+	}
+
 	setGroups(resp.Auth, user, groups)
 
 	return resp, nil
 }
 
 func (b *backend) pathRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	encodedToken, ok := req.Auth.InternalData["token"].(string)
-	if !ok {
-		return nil, errors.New("no refresh token from previous login")
-	}
-
 	config, err := b.config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := decodeToken(encodedToken)
-	if err != nil {
-		return nil, err
+	authType, _ := req.Auth.InternalData["type"].(string)
+
+	if authType == typeServiceAccount {
+		return b.renewServiceAccount(ctx, req, config)
 	}
 
-	authType, ok := req.Auth.InternalData["type"].(string)
+	var user *goauth.Userinfoplus
+	if authType == typeJWT {
+		// ID tokens can't be refreshed, so the user of the login is used
+		user = &goauth.Userinfoplus{
+			Email: req.Auth.Metadata["username"],
+			Hd:    req.Auth.Metadata["domain"],
+		}
+	} else {
+		encodedToken, ok := req.Auth.InternalData["token"].(string)
+		if !ok {
+			return nil, errors.New("no refresh token from previous login")
+		}
+
+		token, err := b.decryptToken(ctx, req.Storage, encodedToken)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = b.user.authUser(ctx, config.oauth2Config(authType), config.userinfoURL(), token)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	user, groups, err := b.authenticate(ctx, config, token, authType)
+	account, err := b.validateAccount(ctx, config, user)
 	if err != nil {
-		return nil, err
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if !config.authorised(user, groups) {
-		return logical.ErrorResponse("user is not allowed to login"), nil
+	groups, err := b.userGroups(ctx, req.Storage, config, user)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	roleName, role, errResp, err := b.renewRole(ctx, req)
+	if errResp != nil || err != nil {
+		return errResp, err
+	}
+
+	if err := authorise(config, roleName, role, user, account, groups); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	resp := &logical.Response{Auth: req.Auth}
+	resp.Auth.TTL, resp.Auth.MaxTTL = role.ttls(config, authType)
+
+	grantID, _ := req.Auth.InternalData["grant"].(string)
+	if err := b.renewGrant(ctx, req, grantID, resp.Auth.TTL); err != nil {
+		return nil, err
+	}
 
 	// Remove old aliases
 	resp.Auth.GroupAliases = nil
@@ -148,6 +319,76 @@ func (b *backend) pathRenew(ctx context.Context, req *logical.Request, d *framew
 	return resp, nil
 }
 
+// renewRole returns the role of the login to renew, it's checked that the
+// role still exists and its policies haven't changed
+func (b *backend) renewRole(ctx context.Context, req *logical.Request) (string, *role, *logical.Response, error) {
+	roleName, _ := req.Auth.InternalData["role"].(string)
+	if roleName == "" {
+		return "", nil, nil, nil
+	}
+
+	role, err := b.role(ctx, req.Storage, roleName)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if role == nil {
+		return "", nil, logical.ErrorResponse(fmt.Sprintf("role %q no longer exists", roleName)), nil
+	}
+
+	if !policyutil.EquivalentPolicies(role.Policies, req.Auth.TokenPolicies) {
+		return "", nil, logical.ErrorResponse(fmt.Sprintf("policies of role %q have changed, not renewing", roleName)), nil
+	}
+
+	return roleName, role, nil, nil
+}
+
+// renewServiceAccount checks the service account of the login is still
+// allowed by its role
+func (b *backend) renewServiceAccount(ctx context.Context, req *logical.Request, config *config) (*logical.Response, error) {
+	roleName, role, errResp, err := b.renewRole(ctx, req)
+	if errResp != nil || err != nil {
+		return errResp, err
+	}
+
+	// JWTs can't be refreshed, so the service account of the login is used
+	sa := &serviceAccount{
+		Email:        req.Auth.Metadata["service_account"],
+		ProjectID:    req.Auth.Metadata["project_id"],
+		Zone:         req.Auth.Metadata["zone"],
+		InstanceName: req.Auth.Metadata["instance_name"],
+	}
+
+	if err := authoriseServiceAccount(config, roleName, role, sa); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	resp := &logical.Response{Auth: req.Auth}
+	resp.Auth.TTL, resp.Auth.MaxTTL = role.ttls(config, typeServiceAccount)
+	return resp, nil
+}
+
+// authorise checks the user against the bindings of the role, which replace
+// the allowed lists of the config. Logins without a role are checked against
+// the allowed lists, the denied lists always apply.
+func authorise(config *config, roleName string, role *role, user *goauth.Userinfoplus, account *admin.User, groups []*admin.Group) error {
+	if role == nil {
+		if !config.authorised(user, account, groups) {
+			return errors.New("user is not allowed to login")
+		}
+		return nil
+	}
+
+	if config.denied(user, groups) {
+		return errors.New("user is not allowed to login")
+	}
+
+	if !role.authorised(user, groups) {
+		return fmt.Errorf("user is not allowed to login with role %q", roleName)
+	}
+
+	return nil
+}
+
 func setGroups(auth *logical.Auth, user *goauth.Userinfoplus, groups []*admin.Group) {
 	// add every associated group
 	for _, group := range groups {
@@ -167,19 +408,33 @@ func setGroups(auth *logical.Auth, user *goauth.Userinfoplus, groups []*admin.Gr
 	})
 }
 
-func (b *backend) authenticate(ctx context.Context, config *config, token *oauth2.Token, authType string) (*goauth.Userinfoplus, []*admin.Group, error) {
-	oauth2config := config.oauth2Config(authType)
-
-	user, err := b.user.authUser(ctx, oauth2config, token)
-	if err != nil {
-		return nil, nil, err
+// userGroups returns the groups of the user, failed lookups are handled
+// according to the configured failure mode
+func (b *backend) userGroups(ctx context.Context, s logical.Storage, config *config, user *goauth.Userinfoplus) ([]*admin.Group, error) {
+	groups, err := b.lookupGroups(ctx, s, config, user.Email)
+	if err == nil {
+		return groups, nil
 	}
 
-	groups, err := b.groups.groupsPerUser(ctx, config, user.Email)
-	if err != nil {
-		b.Logger().Warn("querying the admin directory API for the groups for the user failed: ", "user", user, "error", "err")
-		groups = []*admin.Group{}
-	}
+	b.Logger().Warn("querying the admin directory API for the groups of the user failed", "user", user.Email, "error", err)
 
-	return user, groups, nil
+	errLookup := errors.New("unable to look up the groups of the user")
+
+	switch config.groupsLookupFailureMode() {
+	case groupsLookupFailureModeDeny:
+		return nil, errLookup
+	case groupsLookupFailureModeCached:
+		item, err := b.groupsCache.get(ctx, s, config, strings.ToLower(user.Email))
+		if err != nil {
+			return nil, err
+		}
+		// without a previous successful lookup nothing is known
+		if item == nil || item.Fetched.IsZero() {
+			return nil, errLookup
+		}
+		b.Logger().Info("using the last known groups of the user", "user", user.Email, "fetched", item.Fetched)
+		return item.Groups, nil
+	default:
+		return []*admin.Group{}, nil
+	}
 }
@@ -0,0 +1,245 @@
+package google
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"google.golang.org/api/admin/directory/v1"
+	goauth "google.golang.org/api/oauth2/v2"
+)
+
+const (
+	rolePath  = "role/"
+	roleEntry = "role/"
+
+	roleNameParameterName = "name"
+	roleParameterName     = "role"
+
+	boundDomainsRolePropertyName = "bound_domains"
+	boundEmailsRolePropertyName  = "bound_emails"
+	boundGroupsRolePropertyName  = "bound_groups"
+
+	boundServiceAccountsRolePropertyName = "bound_service_accounts"
+	boundProjectsRolePropertyName        = "bound_projects"
+	boundZonesRolePropertyName           = "bound_zones"
+
+	policiesRolePropertyName = "policies"
+	ttlRolePropertyName      = "ttl"
+	maxTTLRolePropertyName   = "max_ttl"
+)
+
+type role struct {
+	BoundDomains []string `json:"bound_domains" description:"Domains of users allowed to login with this role"`
+	BoundEmails  []string `json:"bound_emails" description:"Email addresses of users allowed to login with this role"`
+	BoundGroups  []string `json:"bound_groups" description:"Groups of users allowed to login with this role"`
+
+	BoundServiceAccounts []string `json:"bound_service_accounts" description:"Emails of service accounts allowed to login with this role"`
+	BoundProjects        []string `json:"bound_projects" description:"Projects of service accounts allowed to login with this role"`
+	BoundZones           []string `json:"bound_zones" description:"Zones of Compute Engine instances allowed to login with this role"`
+
+	Policies []string      `json:"policies" description:"Policies attached to tokens issued for this role"`
+	TTL      time.Duration `json:"ttl" description:"Duration after which authentication with this role will be expired, overrides the config TTLs"`
+	MaxTTL   time.Duration `json:"max_ttl" description:"Maximum duration after which authentication with this role will be expired, overrides the config max TTLs"`
+}
+
+func rolePathFields() map[string]*framework.FieldSchema {
+	output := structFieldSchemas(&role{})
+	output[roleNameParameterName] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the role.",
+	}
+	return output
+}
+
+func pathsRole(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: rolePath + "?$",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRoleList,
+			},
+		},
+		{
+			Pattern: rolePath + framework.GenericNameRegex(roleNameParameterName),
+			Fields:  rolePathFields(),
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.pathRoleWrite,
+				logical.ReadOperation:   b.pathRoleRead,
+				logical.DeleteOperation: b.pathRoleDelete,
+			},
+		},
+	}
+}
+
+func (b *backend) pathRoleList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, roleEntry)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(roles), nil
+}
+
+func (b *backend) pathRoleRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	role, err := b.role(ctx, req.Storage, data.Get(roleNameParameterName).(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: structMapWithoutSecrets(role),
+	}, nil
+}
+
+func (b *backend) pathRoleWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(data.Get(roleNameParameterName).(string))
+
+	// get potentially existing role
+	r, err := b.role(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = &role{}
+	}
+
+	if _, err := updateStruct(r, data); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	r.Policies = policyutil.SanitizePolicies(r.Policies, policyutil.DoNotAddDefaultPolicy)
+
+	// a role without bindings would hand its policies to any Google account
+	if len(r.BoundDomains)+len(r.BoundEmails)+len(r.BoundGroups)+len(r.BoundServiceAccounts)+len(r.BoundProjects) == 0 {
+		return logical.ErrorResponse(fmt.Sprintf("at least one of %s, %s, %s, %s or %s is required",
+			boundDomainsRolePropertyName, boundEmailsRolePropertyName, boundGroupsRolePropertyName,
+			boundServiceAccountsRolePropertyName, boundProjectsRolePropertyName)), nil
+	}
+
+	if r.MaxTTL > 0 && r.TTL > r.MaxTTL {
+		return logical.ErrorResponse(fmt.Sprintf("%s must not be greater than %s", ttlRolePropertyName, maxTTLRolePropertyName)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(roleEntry+name, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathRoleDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(data.Get(roleNameParameterName).(string))
+	return nil, req.Storage.Delete(ctx, roleEntry+name)
+}
+
+// role returns the role with the given name, nil if it doesn't exist.
+func (b *backend) role(ctx context.Context, s logical.Storage, name string) (*role, error) {
+	entry, err := s.Get(ctx, roleEntry+strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result role
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, fmt.Errorf("error reading role: %s", err)
+	}
+
+	return &result, nil
+}
+
+// serviceAccountsOnly returns if the role binds service accounts but no
+// users
+func (r *role) serviceAccountsOnly() bool {
+	return len(r.BoundServiceAccounts)+len(r.BoundProjects) > 0 &&
+		len(r.BoundDomains)+len(r.BoundEmails)+len(r.BoundGroups) == 0
+}
+
+// authorised checks that the user satisfies every binding configured for the
+// role.
+func (r *role) authorised(user *goauth.Userinfoplus, groups []*admin.Group) bool {
+	allowed, _ := r.authorisation(user, groups)
+	return allowed
+}
+
+// authorisation is authorised, which also explains the decision
+func (r *role) authorisation(user *goauth.Userinfoplus, groups []*admin.Group) (bool, string) {
+	if r.serviceAccountsOnly() {
+		return false, "role only binds service accounts"
+	}
+
+	if len(r.BoundDomains) > 0 && !stringInSliceCaseInsensitive(user.Hd, r.BoundDomains) {
+		return false, fmt.Sprintf("domain %q is not in bound_domains", user.Hd)
+	}
+
+	if len(r.BoundEmails) > 0 && !stringInSliceCaseInsensitive(user.Email, r.BoundEmails) {
+		return false, fmt.Sprintf("email %q is not in bound_emails", user.Email)
+	}
+
+	if len(r.BoundGroups) > 0 {
+		userGroups := groupEmails(groups)
+		found := false
+		for _, boundGroup := range r.BoundGroups {
+			if stringInSliceCaseInsensitive(boundGroup, userGroups) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, "no group is in bound_groups"
+		}
+	}
+
+	return true, "all role bindings are satisfied"
+}
+
+// authorisedServiceAccount checks that the service account satisfies every
+// service account binding of the role, roles without service account or
+// project bindings don't allow service accounts.
+func (r *role) authorisedServiceAccount(sa *serviceAccount) bool {
+	if len(r.BoundServiceAccounts)+len(r.BoundProjects) == 0 {
+		return false
+	}
+
+	if len(r.BoundServiceAccounts) > 0 && !stringInSliceCaseInsensitive(sa.Email, r.BoundServiceAccounts) {
+		return false
+	}
+
+	if len(r.BoundProjects) > 0 && (sa.ProjectID == "" || !stringInSliceCaseInsensitive(sa.ProjectID, r.BoundProjects)) {
+		return false
+	}
+
+	if len(r.BoundZones) > 0 && (sa.Zone == "" || !stringInSliceCaseInsensitive(sa.Zone, r.BoundZones)) {
+		return false
+	}
+
+	return true
+}
+
+// ttls returns the lease durations for the role, falling back to the config
+// for the auth type.
+func (r *role) ttls(c *config, authType string) (ttl time.Duration, maxTTL time.Duration) {
+	ttl, maxTTL = c.ttlForType(authType)
+	if r == nil {
+		return ttl, maxTTL
+	}
+	if r.TTL > 0 {
+		ttl = r.TTL
+	}
+	if r.MaxTTL > 0 {
+		maxTTL = r.MaxTTL
+	}
+	return ttl, maxTTL
+}
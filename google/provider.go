@@ -2,22 +2,67 @@ package google
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
 	goauth "google.golang.org/api/oauth2/v2"
 )
 
+const (
+	defaultDeviceAuthURL = "https://oauth2.googleapis.com/device/code"
+	defaultUserinfoURL   = "https://www.googleapis.com/oauth2/v2/userinfo"
+	defaultDirectoryURL  = "https://www.googleapis.com/admin/directory/v1/"
+	deviceCodeGrantType  = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
 type googleProvider struct {
+	// directory client, reused until the credentials or the impersonated
+	// user change
+	directoryLock    sync.Mutex
+	directoryKey     string
+	directoryService *admin.Service
+}
+
+// deviceAuth is the response of a started device authorization grant
+type deviceAuth struct {
+	DeviceCode      string
+	UserCode        string
+	VerificationURL string
+	ExpiresIn       time.Duration
+	Interval        time.Duration
+}
+
+// oauth2Error is an error response of an OAuth 2.0 endpoint
+type oauth2Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauth2Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
 }
 
 // UserProvider does the authentication of user with oauth2
 type UserProvider interface {
-	authUser(ctx context.Context, config *oauth2.Config, token *oauth2.Token) (*goauth.Userinfoplus, error)
-	oauth2Exchange(ctx context.Context, code string, config *oauth2.Config) (*oauth2.Token, error)
+	authUser(ctx context.Context, config *oauth2.Config, userinfoURL string, token *oauth2.Token) (*goauth.Userinfoplus, error)
+	oauth2Exchange(ctx context.Context, code string, config *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	deviceAuth(ctx context.Context, config *oauth2.Config, deviceAuthURL string) (*deviceAuth, error)
+	deviceToken(ctx context.Context, config *oauth2.Config, deviceCode string) (*oauth2.Token, error)
+	revokeToken(ctx context.Context, revocationURL string, token string) error
 }
 
 // GroupsProvider maps a user to its groups
@@ -25,56 +70,218 @@ type GroupsProvider interface {
 	groupsPerUser(ctx context.Context, config *config, userKey string) ([]*admin.Group, error)
 }
 
+// clientResetter is implemented by providers, which cache API clients
+// created from the config
+type clientResetter interface {
+	resetClients()
+}
+
+// AccountProvider looks up the directory account of a user
+type AccountProvider interface {
+	lookupUser(ctx context.Context, config *config, userKey string) (*admin.User, error)
+}
+
 var _ UserProvider = &googleProvider{}
 var _ GroupsProvider = &googleProvider{}
+var _ AccountProvider = &googleProvider{}
+var _ clientResetter = &googleProvider{}
 
-func (p *googleProvider) oauth2Exchange(ctx context.Context, code string, config *oauth2.Config) (*oauth2.Token, error) {
-	return config.Exchange(ctx, code)
+func (p *googleProvider) oauth2Exchange(ctx context.Context, code string, config *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return config.Exchange(ctx, code, opts...)
 }
 
-func (p *googleProvider) authUser(ctx context.Context, config *oauth2.Config, token *oauth2.Token) (*goauth.Userinfoplus, error) {
-	client := config.Client(ctx, token)
-	userService, err := goauth.New(client)
+// deviceAuth starts an OAuth 2.0 device authorization grant
+func (p *googleProvider) deviceAuth(ctx context.Context, config *oauth2.Config, deviceAuthURL string) (*deviceAuth, error) {
+	body, err := postForm(ctx, deviceAuthURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	user, err := goauth.NewUserinfoV2MeService(userService).Get().Do()
+	var resp struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding device authorization response: %s", err)
+	}
+
+	// Google uses a non standard field name for the verification URI
+	verificationURL := resp.VerificationURL
+	if verificationURL == "" {
+		verificationURL = resp.VerificationURI
+	}
+
+	return &deviceAuth{
+		DeviceCode:      resp.DeviceCode,
+		UserCode:        resp.UserCode,
+		VerificationURL: verificationURL,
+		ExpiresIn:       time.Duration(resp.ExpiresIn) * time.Second,
+		Interval:        time.Duration(resp.Interval) * time.Second,
+	}, nil
+}
+
+// deviceToken polls once for the token of a device authorization grant
+func (p *googleProvider) deviceToken(ctx context.Context, config *oauth2.Config, deviceCode string) (*oauth2.Token, error) {
+	body, err := postForm(ctx, config.Endpoint.TokenURL, url.Values{
+		"client_id":     {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"device_code":   {deviceCode},
+		"grant_type":    {deviceCodeGrantType},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	var resp struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding device token response: %s", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.New("device token response contains no access token")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  resp.AccessToken,
+		TokenType:    resp.TokenType,
+		RefreshToken: resp.RefreshToken,
+	}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// revokeToken revokes an OAuth 2.0 token at the revocation endpoint
+func (p *googleProvider) revokeToken(ctx context.Context, revocationURL string, token string) error {
+	_, err := postForm(ctx, revocationURL, url.Values{
+		"token": {token},
+	})
+	return err
 }
 
-func (p *googleProvider) directoryService(ctx context.Context, config *config) (*admin.Service, error) {
+// postForm posts the values to an OAuth 2.0 endpoint and returns the response
+// body. OAuth 2.0 error responses are returned as oauth2Error.
+func postForm(ctx context.Context, endpoint string, values url.Values) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp oauth2Error
+		contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if contentType == "application/json" && json.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+			return nil, &errResp
+		}
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, endpoint)
+	}
+
+	return body, nil
+}
+
+// httpClient returns the client set in the context like the oauth2 package
+// does
+func httpClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && c != nil {
+		return c
+	}
+	return http.DefaultClient
+}
+
+// authUser looks up the user the token belongs to at the userinfo endpoint
+func (p *googleProvider) authUser(ctx context.Context, config *oauth2.Config, userinfoURL string, token *oauth2.Token) (*goauth.Userinfoplus, error) {
+	req, err := http.NewRequest(http.MethodGet, userinfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := config.Client(ctx, token).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var user goauth.Userinfoplus
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("error decoding userinfo response: %s", err)
+	}
+
+	return &user, nil
+}
+
+func (p *googleProvider) directory(ctx context.Context, config *config) (*admin.Service, error) {
 	if config == nil {
 		return nil, errors.New("missing config")
 	}
-	// TODO: Handle unconfigured service account
 
-	jwtConfig, err := google.JWTConfigFromJSON([]byte(config.DirectoryServiceAccounyKey), admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
+	key := config.credentialsKey(config.DirectoryImpersonateUser) + "\x00" + config.directoryURL()
+
+	p.directoryLock.Lock()
+	defer p.directoryLock.Unlock()
+
+	if p.directoryService != nil && p.directoryKey == key {
+		return p.directoryService, nil
+	}
+
+	client, err := credentialsClient(ctx, config, config.DirectoryImpersonateUser, admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
 	if err != nil {
 		return nil, err
 	}
-	jwtConfig.Subject = config.DirectoryImpersonateUser
-
-	client := jwtConfig.Client(ctx)
 
 	srv, err := admin.New(client)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create directory service %v", err)
 	}
+	srv.BasePath = config.directoryURL()
+
+	p.directoryKey = key
+	p.directoryService = srv
 	return srv, nil
 }
 
+// resetClients drops the cached directory client
+func (p *googleProvider) resetClients() {
+	p.directoryLock.Lock()
+	defer p.directoryLock.Unlock()
+	p.directoryKey = ""
+	p.directoryService = nil
+}
+
 func (p *googleProvider) groupsPerUser(ctx context.Context, config *config, userKey string) (groups []*admin.Group, err error) {
 	// skip groups check if service account is not configured
-	if len(config.DirectoryImpersonateUser) == 0 || len(config.DirectoryServiceAccounyKey) == 0 {
+	if !config.directoryConfigured() {
 		return []*admin.Group{}, nil
 	}
 
-	svc, err := p.directoryService(ctx, config)
+	svc, err := p.directory(ctx, config)
 	if err != nil {
 		return []*admin.Group{}, err
 	}
@@ -82,7 +289,7 @@ func (p *googleProvider) groupsPerUser(ctx context.Context, config *config, user
 	query := svc.Groups.List().UserKey(userKey)
 
 	for {
-		resp, err := query.Do()
+		resp, err := query.Context(ctx).Do()
 		if err != nil {
 			return []*admin.Group{}, err
 		}
@@ -96,3 +303,12 @@ func (p *googleProvider) groupsPerUser(ctx context.Context, config *config, user
 
 	return groups, nil
 }
+
+func (p *googleProvider) lookupUser(ctx context.Context, config *config, userKey string) (*admin.User, error) {
+	svc, err := p.directory(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return svc.Users.Get(userKey).Context(ctx).Do()
+}
@@ -0,0 +1,219 @@
+package google
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	grantEntry = "grant/"
+
+	defaultRevocationURL = "https://oauth2.googleapis.com/revoke"
+
+	// attempts to revoke a token during a single sweep
+	revocationAttempts = 3
+
+	// sweeps after which failing revocations are logged as errors
+	revocationMaxSweeps = 10
+)
+
+// delay between attempts to revoke a token
+var revocationRetryDelay = time.Second
+
+// grant tracks the Google token of a login, so it can be revoked once the
+// Vault token expires. Vault doesn't notify auth methods of revoked tokens,
+// the expiry is therefore extended on every renewal.
+type grant struct {
+	Token      string    `json:"token"`
+	User       string    `json:"user"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	MaxExpires time.Time `json:"max_expires"`
+	Attempts   int       `json:"attempts"`
+}
+
+func (b *backend) grant(ctx context.Context, s logical.Storage, id string) (*grant, error) {
+	entry, err := s.Get(ctx, grantEntry+id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result = &grant{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, fmt.Errorf("error reading grant: %s", err)
+	}
+
+	return result, nil
+}
+
+func (b *backend) putGrant(ctx context.Context, s logical.Storage, id string, g *grant) error {
+	entry, err := logical.StorageEntryJSON(grantEntry+id, g)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// leaseExpiry returns when a lease with the ttls expires, the system
+// defaults are used for ttls that are not set
+func (b *backend) leaseExpiry(now time.Time, ttl, maxTTL time.Duration) (expires time.Time, maxExpires time.Time) {
+	if ttl <= 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+	if maxTTL <= 0 {
+		maxTTL = b.System().MaxLeaseTTL()
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return now.Add(ttl), now.Add(maxTTL)
+}
+
+// trackGrant stores the token of a login, returns the id of the grant or an
+// empty string if the token is not tracked
+func (b *backend) trackGrant(ctx context.Context, req *logical.Request, config *config, user string, encodedToken string, ttl, maxTTL time.Duration) (string, error) {
+	if config.DisableTokenRevocation || req.Operation == logical.AliasLookaheadOperation {
+		return "", nil
+	}
+
+	idByte, err := uuid.GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(idByte)
+
+	now := time.Now()
+	g := &grant{
+		Token:   encodedToken,
+		User:    user,
+		Created: now,
+	}
+	g.Expires, g.MaxExpires = b.leaseExpiry(now, ttl, maxTTL)
+
+	if err := b.putGrant(ctx, req.Storage, id, g); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// renewGrant extends the expiry of the grant of a renewed login
+func (b *backend) renewGrant(ctx context.Context, req *logical.Request, id string, ttl time.Duration) error {
+	if id == "" {
+		return nil
+	}
+
+	g, err := b.grant(ctx, req.Storage, id)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		return nil
+	}
+
+	g.Expires, _ = b.leaseExpiry(time.Now(), ttl, 0)
+	if g.Expires.After(g.MaxExpires) {
+		g.Expires = g.MaxExpires
+	}
+
+	return b.putGrant(ctx, req.Storage, id, g)
+}
+
+// revokeExpiredGrants revokes the Google tokens of expired logins
+func (b *backend) revokeExpiredGrants(ctx context.Context, req *logical.Request) error {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	ids, err := req.Storage.List(ctx, grantEntry)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	grants := make(map[string]*grant, len(ids))
+	for _, id := range ids {
+		g, err := b.grant(ctx, req.Storage, id)
+		if err != nil {
+			return err
+		}
+		if g != nil {
+			grants[id] = g
+		}
+	}
+
+	for id, g := range grants {
+		if g.Expires.After(now) {
+			continue
+		}
+
+		// grants are only dropped once their token is revoked, apart from
+		// grants tracked before revocation was disabled
+		if !config.DisableTokenRevocation {
+			if err := b.revokeGrant(ctx, req.Storage, config, g); err != nil {
+				g.Attempts++
+				if g.Attempts < revocationMaxSweeps {
+					b.Logger().Warn("revoking the Google token of an expired login failed, retrying later", "user", g.User, "attempts", g.Attempts, "error", err)
+				} else {
+					b.Logger().Error("revoking the Google token of an expired login keeps failing", "user", g.User, "attempts", g.Attempts, "error", err)
+				}
+				if err := b.putGrant(ctx, req.Storage, id, g); err != nil {
+					return err
+				}
+				continue
+			}
+			b.Logger().Info("revoked the Google token of an expired login", "user", g.User, "created", g.Created)
+		}
+
+		if err := req.Storage.Delete(ctx, grantEntry+id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeGrant revokes the token of the grant, retrying failed attempts
+func (b *backend) revokeGrant(ctx context.Context, s logical.Storage, config *config, g *grant) error {
+	token, err := b.decryptToken(ctx, s, g.Token)
+	if err != nil {
+		return err
+	}
+
+	// revoking the refresh token also revokes its access tokens
+	value := token.RefreshToken
+	if value == "" {
+		value = token.AccessToken
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = b.user.revokeToken(ctx, config.revocationURL(), value)
+		if err == nil {
+			return nil
+		}
+
+		// the token has already expired or was revoked
+		if oauth2Err, ok := err.(*oauth2Error); ok && oauth2Err.Code == "invalid_token" {
+			return nil
+		}
+
+		if attempt >= revocationAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(revocationRetryDelay * time.Duration(attempt)):
+		}
+	}
+}
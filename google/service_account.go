@@ -0,0 +1,230 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	typeServiceAccount = "service_account"
+
+	// URL of the public keys of a service account
+	defaultServiceAccountJWKSURL = "https://www.googleapis.com/service_accounts/v1/jwk/" + emailPlaceholder
+
+	serviceAccountDomain    = ".gserviceaccount.com"
+	serviceAccountIAMDomain = ".iam.gserviceaccount.com"
+
+	// maximum lifetime of self-signed JWTs, which limits their replay
+	serviceAccountJWTMaxLifetime = 15 * time.Minute
+)
+
+// serviceAccount is a workload authenticated by a JWT
+type serviceAccount struct {
+	Email        string
+	ProjectID    string
+	Zone         string
+	InstanceName string
+}
+
+type serviceAccountClaims struct {
+	jwt.Claims
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Google        struct {
+		ComputeEngine struct {
+			ProjectID    string `json:"project_id"`
+			Zone         string `json:"zone"`
+			InstanceName string `json:"instance_name"`
+		} `json:"compute_engine"`
+	} `json:"google"`
+}
+
+func isServiceAccountEmail(email string) bool {
+	return strings.HasSuffix(strings.ToLower(email), serviceAccountDomain)
+}
+
+// serviceAccountProject returns the project of user-managed service accounts
+func serviceAccountProject(email string) string {
+	email = strings.ToLower(email)
+	if !strings.HasSuffix(email, serviceAccountIAMDomain) {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimSuffix(email, serviceAccountIAMDomain), "@", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// isServiceAccountJWT returns if the JWT is issued for or by a service
+// account, the signature is not verified.
+func isServiceAccountJWT(rawToken string) bool {
+	token, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return false
+	}
+	var claims serviceAccountClaims
+	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return false
+	}
+	return isServiceAccountEmail(claims.Issuer) || isServiceAccountEmail(claims.Email)
+}
+
+// verifyServiceAccountJWT verifies a Google-signed ID token of a service
+// account or a JWT self-signed with the key of a service account. Self-signed
+// JWTs are only verified if the role binds the service account and need one of
+// the configured jwt_audiences, the client IDs aren't used as a fallback.
+func (b *backend) verifyServiceAccountJWT(ctx context.Context, config *config, rawToken string, roleName string, role *role) (*serviceAccount, error) {
+	token, header, err := parseSignedJWT(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var unverified serviceAccountClaims
+	if err := token.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, fmt.Errorf("error parsing ID token: %s", err)
+	}
+
+	selfSigned := !stringInSlice(unverified.Issuer, googleIssuers)
+
+	var keysURL string
+	if selfSigned {
+		if !isServiceAccountEmail(unverified.Issuer) {
+			return nil, fmt.Errorf("unexpected ID token issuer: %s", unverified.Issuer)
+		}
+
+		// the audience of self-signed JWTs is chosen by the service account,
+		// the client IDs are public and would match JWTs meant for other apps
+		if len(config.JWTAudiences) == 0 {
+			return nil, fmt.Errorf("%s must be configured to login with self-signed JWTs", jwtAudiencesConfigPropertyName)
+		}
+
+		// prevent fetching the keys of arbitrary service accounts
+		sa := &serviceAccount{
+			Email:     unverified.Issuer,
+			ProjectID: serviceAccountProject(unverified.Issuer),
+		}
+		if err := authoriseServiceAccount(config, roleName, role, sa); err != nil {
+			return nil, err
+		}
+
+		keysURL = config.serviceAccountJWKSURL(unverified.Issuer)
+	} else {
+		keysURL = config.jwksURL()
+	}
+
+	key, err := b.jwks.key(ctx, keysURL, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims serviceAccountClaims
+	if err := token.Claims(key, &claims); err != nil {
+		return nil, fmt.Errorf("error verifying ID token: %s", err)
+	}
+
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, jwtLeeway); err != nil {
+		return nil, fmt.Errorf("error validating ID token: %s", err)
+	}
+
+	if claims.Expiry == nil {
+		return nil, errors.New("ID token has no expiry")
+	}
+
+	if err := validateAudience(config, claims.Audience); err != nil {
+		return nil, err
+	}
+
+	sa := &serviceAccount{}
+	if selfSigned {
+		if claims.Subject != "" && claims.Subject != claims.Issuer {
+			return nil, errors.New("subject of self-signed JWT must match its issuer")
+		}
+		if claims.IssuedAt == nil || claims.Expiry.Time().Sub(claims.IssuedAt.Time()) > serviceAccountJWTMaxLifetime {
+			return nil, fmt.Errorf("self-signed JWT must not be valid for more than %s", serviceAccountJWTMaxLifetime)
+		}
+		sa.Email = claims.Issuer
+	} else {
+		if !isServiceAccountEmail(claims.Email) {
+			return nil, errors.New("ID token is not issued for a service account")
+		}
+		if !claims.EmailVerified {
+			return nil, errors.New("email of ID token is not verified")
+		}
+		sa.Email = claims.Email
+		sa.Zone = claims.Google.ComputeEngine.Zone
+		sa.InstanceName = claims.Google.ComputeEngine.InstanceName
+		sa.ProjectID = claims.Google.ComputeEngine.ProjectID
+	}
+	if sa.ProjectID == "" {
+		sa.ProjectID = serviceAccountProject(sa.Email)
+	}
+
+	return sa, nil
+}
+
+// authoriseServiceAccount checks the service account against denied_users
+// and the role, service accounts require a role binding them
+func authoriseServiceAccount(config *config, roleName string, role *role, sa *serviceAccount) error {
+	if config.deniedServiceAccount(sa) {
+		return errors.New("service account is not allowed to login")
+	}
+
+	if role == nil {
+		return errors.New("a role is required to login with a service account")
+	}
+
+	if !role.authorisedServiceAccount(sa) {
+		return fmt.Errorf("service account is not allowed to login with role %q", roleName)
+	}
+
+	return nil
+}
+
+func serviceAccountMetadata(sa *serviceAccount) map[string]string {
+	return map[string]string{
+		"service_account": sa.Email,
+		"project_id":      sa.ProjectID,
+		"zone":            sa.Zone,
+		"instance_name":   sa.InstanceName,
+	}
+}
+
+// serviceAccountLoginResponse builds the auth response for a service account
+func (b *backend) serviceAccountLoginResponse(config *config, sa *serviceAccount, roleName string, role *role) (*logical.Response, error) {
+	if err := authoriseServiceAccount(config, roleName, role, sa); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	ttl, maxTTL := role.ttls(config, typeServiceAccount)
+
+	metadata := serviceAccountMetadata(sa)
+	metadata["role"] = roleName
+
+	return &logical.Response{
+		Auth: &logical.Auth{
+			InternalData: map[string]interface{}{
+				"type": typeServiceAccount,
+				"role": roleName,
+			},
+			Metadata:    metadata,
+			DisplayName: sa.Email,
+			Policies:    role.Policies,
+			LeaseOptions: logical.LeaseOptions{
+				TTL:       ttl,
+				MaxTTL:    maxTTL,
+				Renewable: true,
+			},
+			Alias: &logical.Alias{
+				Name:     sa.Email,
+				Metadata: serviceAccountMetadata(sa),
+			},
+		},
+	}, nil
+}
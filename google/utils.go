@@ -1,9 +1,17 @@
 package google
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/vault/sdk/framework"
 	"golang.org/x/oauth2"
+	"google.golang.org/api/admin/directory/v1"
 )
 
 func encodeToken(token *oauth2.Token) (string, error) {
@@ -21,3 +29,228 @@ func decodeToken(encoded string) (*oauth2.Token, error) {
 	}
 	return &token, nil
 }
+
+// pkceChallenge returns the S256 code challenge for a PKCE code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, elem := range slice {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stringInSliceCaseInsensitive(s string, slice []string) bool {
+	s = strings.ToLower(s)
+	for _, elem := range slice {
+		if strings.ToLower(elem) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// list of groups and aliases of the user
+func groupEmails(groups []*admin.Group) []string {
+	emails := []string{}
+	for _, group := range groups {
+		emails = append(emails, group.Email)
+		emails = append(emails, group.Aliases...)
+	}
+	return emails
+}
+
+// structFieldSchemas builds the field schemas for every json tagged field of
+// the struct obj points to.
+func structFieldSchemas(obj interface{}) map[string]*framework.FieldSchema {
+	output := make(map[string]*framework.FieldSchema)
+
+	t := reflect.TypeOf(obj).Elem()
+	v := reflect.ValueOf(obj).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		tagJSON := t.Field(i).Tag.Get("json")
+		tagDescription := t.Field(i).Tag.Get("description")
+
+		// skip fields without json tag
+		if tagJSON == "" {
+			continue
+		}
+
+		val := v.Field(i)
+		switch val.Type().String() {
+		case "string":
+			output[tagJSON] = &framework.FieldSchema{
+				Description: tagDescription,
+				Type:        framework.TypeString,
+			}
+		case "bool":
+			output[tagJSON] = &framework.FieldSchema{
+				Description: tagDescription,
+				Type:        framework.TypeBool,
+			}
+		case "int":
+			output[tagJSON] = &framework.FieldSchema{
+				Description: tagDescription,
+				Type:        framework.TypeInt,
+			}
+		case "time.Duration":
+			output[tagJSON] = &framework.FieldSchema{
+				Description: tagDescription,
+				Type:        framework.TypeDurationSecond,
+			}
+		case "[]string":
+			output[tagJSON] = &framework.FieldSchema{
+				Description: tagDescription,
+				Type:        framework.TypeCommaStringSlice,
+			}
+		default:
+			panic(fmt.Sprintf("unknown type: %v", val.Type()))
+		}
+
+	}
+
+	return output
+}
+
+// updateStruct sets every json tagged field of the struct obj points to,
+// which is supplied in data.
+func updateStruct(obj interface{}, data *framework.FieldData) (changed bool, err error) {
+	t := reflect.TypeOf(obj).Elem()
+	v := reflect.ValueOf(obj).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		tagJSON := t.Field(i).Tag.Get("json")
+
+		// skip fields without json tag
+		if tagJSON == "" {
+			continue
+		}
+
+		// get parameter from input data
+		param, ok := data.GetOk(tagJSON)
+
+		// skip if not supplied
+		if !ok {
+			continue
+		}
+
+		// update struct to new value
+		val := v.Field(i)
+		switch val.Type().String() {
+		case "string":
+			s := param.(string)
+			if val.String() != s {
+				val.SetString(s)
+				changed = true
+			}
+		case "bool":
+			b := param.(bool)
+			if val.Bool() != b {
+				val.SetBool(b)
+				changed = true
+			}
+		case "int":
+			i := int64(param.(int))
+			if val.Int() != i {
+				val.SetInt(i)
+				changed = true
+			}
+		case "time.Duration":
+			value := time.Duration(param.(int)) * time.Second
+			if val.Int() != value.Nanoseconds() {
+				val.SetInt(value.Nanoseconds())
+				changed = true
+			}
+		case "[]string":
+			s := param.([]string)
+			if !reflect.DeepEqual(val.Interface().([]string), s) {
+				val.Set(reflect.ValueOf(s))
+				changed = true
+			}
+		default:
+			return false, fmt.Errorf("unknown type for field '%s': %v", tagJSON, val.Type())
+		}
+	}
+	return changed, nil
+}
+
+// resetStructFields sets the json tagged fields of the struct obj points to,
+// which are listed in names, back to their zero value.
+func resetStructFields(obj interface{}, names []string) (changed bool, err error) {
+	t := reflect.TypeOf(obj).Elem()
+	v := reflect.ValueOf(obj).Elem()
+
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < t.NumField(); i++ {
+		tagJSON := t.Field(i).Tag.Get("json")
+
+		// skip fields without json tag
+		if tagJSON == "" {
+			continue
+		}
+
+		fields[tagJSON] = v.Field(i)
+	}
+
+	for _, name := range names {
+		val, ok := fields[name]
+		if !ok {
+			return false, fmt.Errorf("unknown field '%s'", name)
+		}
+
+		zero := reflect.Zero(val.Type())
+		if !reflect.DeepEqual(val.Interface(), zero.Interface()) {
+			val.Set(zero)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// structMapWithoutSecrets returns every json tagged field of the struct obj
+// points to, non-empty fields tagged as secret are redacted.
+func structMapWithoutSecrets(obj interface{}) map[string]interface{} {
+	output := make(map[string]interface{})
+
+	t := reflect.TypeOf(obj).Elem()
+	v := reflect.ValueOf(obj).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		tagJSON := t.Field(i).Tag.Get("json")
+		tagSecret := t.Field(i).Tag.Get("secret")
+
+		// skip fields without json tag
+		if tagJSON == "" {
+			continue
+		}
+
+		secret := tagSecret == "true"
+
+		val := v.Field(i)
+
+		// if not secret, set value in map
+		if !secret {
+			if val.Type() == reflect.TypeOf(time.Duration(0)) {
+				output[tagJSON] = val.Interface().(time.Duration).String()
+			} else {
+				output[tagJSON] = val.Interface()
+			}
+			continue
+		}
+
+		// secret non empty strings should be redacted
+		switch val.Kind() {
+		case reflect.String:
+			// skip empty string
+			if val.String() == "" {
+				output[tagJSON] = ""
+			} else {
+				output[tagJSON] = "<redacted>"
+			}
+		}
+	}
+	return output
+}
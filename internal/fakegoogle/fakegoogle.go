@@ -0,0 +1,677 @@
+// Package fakegoogle provides a stand-in for the Google endpoints used by the
+// plugin, so the whole login and renewal flow can be tested without Google
+// credentials.
+package fakegoogle
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// Issuer of the ID tokens signed by the server
+	Issuer = "https://accounts.google.com"
+
+	authPath                  = "/o/oauth2/v2/auth"
+	tokenPath                 = "/token"
+	revokePath                = "/revoke"
+	userinfoPath              = "/oauth2/v2/userinfo"
+	certsPath                 = "/oauth2/v3/certs"
+	directoryPath             = "/admin/directory/v1/"
+	serviceAccountCertsPath   = "/service_accounts/v1/jwk/"
+	authorizationCodeGrant    = "authorization_code"
+	refreshTokenGrant         = "refresh_token"
+	jwtBearerGrant            = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	defaultTokenLifetime      = time.Hour
+	defaultGroupsPageSize     = 200
+	serviceAccountTokenPrefix = "sa-"
+)
+
+// User is an account of the directory
+type User struct {
+	Email         string
+	HostedDomain  string
+	Name          string
+	Suspended     bool
+	Archived      bool
+	EnrolledIn2SV bool
+	OrgUnitPath   string
+
+	// emails of the groups the user is a direct member of
+	Groups []string
+}
+
+// Group is a group of the directory
+type Group struct {
+	Email string
+	Name  string
+
+	// emails of the groups this group is a direct member of
+	Groups []string
+}
+
+// authorization is a code issued to a user, which hasn't been exchanged yet
+type authorization struct {
+	email         string
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+}
+
+// grant is an access token issued by the server
+type grant struct {
+	email          string
+	serviceAccount bool
+	expires        time.Time
+}
+
+// Server emulates Google's OAuth 2.0, userinfo, JWKS and Admin SDK Directory
+// endpoints. Users, groups and service accounts need to be added before they
+// can be used.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	// lifetime of issued access tokens, tokens with a lifetime below 10s are
+	// refreshed by the oauth2 package whenever they are used
+	TokenLifetime time.Duration
+
+	// number of groups returned per page of a group list
+	GroupsPageSize int
+
+	lock            sync.Mutex
+	key             *rsa.PrivateKey
+	keyID           string
+	users           map[string]*User
+	groups          map[string]*Group
+	serviceAccounts map[string]*rsa.PrivateKey
+	codes           map[string]*authorization
+	accessTokens    map[string]*grant
+	refreshTokens   map[string]string
+	groupsErrors    []int
+	revoked         []string
+	calls           map[string]int
+	counter         int
+}
+
+// New starts a server, which has to be closed after use.
+func New(clientID, clientSecret string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ClientID:       clientID,
+		ClientSecret:   clientSecret,
+		TokenLifetime:  defaultTokenLifetime,
+		GroupsPageSize: defaultGroupsPageSize,
+
+		key:             key,
+		keyID:           "fake-google",
+		users:           make(map[string]*User),
+		groups:          make(map[string]*Group),
+		serviceAccounts: make(map[string]*rsa.PrivateKey),
+		codes:           make(map[string]*authorization),
+		accessTokens:    make(map[string]*grant),
+		refreshTokens:   make(map[string]string),
+		calls:           make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenPath, s.handleToken)
+	mux.HandleFunc(revokePath, s.handleRevoke)
+	mux.HandleFunc(userinfoPath, s.handleUserinfo)
+	mux.HandleFunc(certsPath, s.handleCerts)
+	mux.HandleFunc(directoryPath, s.handleDirectory)
+	mux.HandleFunc(serviceAccountCertsPath, s.handleServiceAccountCerts)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.calls[r.URL.Path]++
+		s.lock.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+
+	return s, nil
+}
+
+func (s *Server) AuthURL() string               { return s.URL + authPath }
+func (s *Server) TokenURL() string              { return s.URL + tokenPath }
+func (s *Server) RevocationURL() string         { return s.URL + revokePath }
+func (s *Server) UserinfoURL() string           { return s.URL + userinfoPath }
+func (s *Server) JWKSURL() string               { return s.URL + certsPath }
+func (s *Server) DirectoryURL() string          { return s.URL + directoryPath }
+func (s *Server) ServiceAccountJWKSURL() string { return s.URL + serviceAccountCertsPath + "{{email}}" }
+
+// AddUser adds or replaces a user of the directory
+func (s *Server) AddUser(u *User) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[strings.ToLower(u.Email)] = u
+}
+
+// AddGroup adds or replaces a group of the directory
+func (s *Server) AddGroup(g *Group) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.groups[strings.ToLower(g.Email)] = g
+}
+
+// AddServiceAccount creates a key for the service account and returns it in
+// the JSON format of the Cloud Console. Tokens issued for the key allow
+// Directory lookups.
+func (s *Server) AddServiceAccount(email string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	s.serviceAccounts[strings.ToLower(email)] = key
+	s.lock.Unlock()
+
+	keyJSON, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   email,
+		"private_key_id": email,
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":      s.TokenURL(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(keyJSON), nil
+}
+
+// Authorize emulates the consent of the user to the code URL returned by
+// the plugin. It returns the code, which is sent to the redirect URI.
+func (s *Server) Authorize(codeURL string, email string) (string, error) {
+	u, err := url.Parse(codeURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme+"://"+u.Host+u.Path != s.AuthURL() {
+		return "", fmt.Errorf("code URL doesn't point to %s", s.AuthURL())
+	}
+
+	q := u.Query()
+	if q.Get("client_id") != s.ClientID {
+		return "", fmt.Errorf("unknown client_id %q", q.Get("client_id"))
+	}
+	if q.Get("response_type") != "code" {
+		return "", fmt.Errorf("unsupported response_type %q", q.Get("response_type"))
+	}
+	if challenge := q.Get("code_challenge"); challenge != "" && q.Get("code_challenge_method") != "S256" {
+		return "", errors.New("code_challenge_method must be S256")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[strings.ToLower(email)]; !ok {
+		return "", fmt.Errorf("unknown user %s", email)
+	}
+
+	code := s.newValue("code")
+	s.codes[code] = &authorization{
+		email:         email,
+		clientID:      q.Get("client_id"),
+		redirectURI:   q.Get("redirect_uri"),
+		codeChallenge: q.Get("code_challenge"),
+	}
+	return code, nil
+}
+
+// IDToken returns an ID token signed by the server for the email
+func (s *Server) IDToken(email string, audience string, lifetime time.Duration) (string, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: s.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", s.keyID),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	hostedDomain := ""
+	if u, ok := s.users[strings.ToLower(email)]; ok {
+		hostedDomain = u.HostedDomain
+	}
+	s.lock.Unlock()
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            Issuer,
+		"sub":            email,
+		"aud":            audience,
+		"iat":            now.Unix(),
+		"exp":            now.Add(lifetime).Unix(),
+		"email":          email,
+		"email_verified": true,
+	}
+	if hostedDomain != "" {
+		claims["hd"] = hostedDomain
+	}
+
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// FailGroups makes the next group list requests fail with the status codes
+func (s *Server) FailGroups(statusCodes ...int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.groupsErrors = append(s.groupsErrors, statusCodes...)
+}
+
+// Revoked returns the tokens revoked at the revocation endpoint
+func (s *Server) Revoked() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.revoked...)
+}
+
+// Calls returns the number of requests to the path
+func (s *Server) Calls(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[path]
+}
+
+// newValue returns a unique value for codes and tokens, s.lock is held by
+// the caller
+func (s *Server) newValue(prefix string) string {
+	s.counter++
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%s-%d-%s", prefix, s.counter, base64.RawURLEncoding.EncodeToString(buf))
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+// writeOAuth2Error writes an error response of the OAuth 2.0 endpoints
+func writeOAuth2Error(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// writeAPIError writes an error response of the Google APIs
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+		},
+	})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuth2Error(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case authorizationCodeGrant:
+		s.handleAuthorizationCode(w, r)
+	case refreshTokenGrant:
+		s.handleRefreshToken(w, r)
+	case jwtBearerGrant:
+		s.handleJWTBearer(w, r)
+	default:
+		writeOAuth2Error(w, http.StatusBadRequest, "unsupported_grant_type", r.PostForm.Get("grant_type"))
+	}
+}
+
+// clientAuthenticated checks the client credentials sent in the header or
+// the body
+func (s *Server) clientAuthenticated(r *http.Request) bool {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	return clientID == s.ClientID && clientSecret == s.ClientSecret
+}
+
+func (s *Server) handleAuthorizationCode(w http.ResponseWriter, r *http.Request) {
+	if !s.clientAuthenticated(r) {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_client", "The OAuth client was not found.")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	code := r.PostForm.Get("code")
+	auth, ok := s.codes[code]
+	if !ok {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "Malformed auth code.")
+		return
+	}
+	delete(s.codes, code)
+
+	if auth.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeOAuth2Error(w, http.StatusBadRequest, "redirect_uri_mismatch", "Bad Request")
+		return
+	}
+
+	if auth.codeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != auth.codeChallenge {
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "Invalid code verifier.")
+			return
+		}
+	}
+
+	refreshToken := s.newValue("refresh")
+	s.refreshTokens[refreshToken] = auth.email
+	s.writeToken(w, &grant{email: auth.email}, refreshToken)
+}
+
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if !s.clientAuthenticated(r) {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_client", "The OAuth client was not found.")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	email, ok := s.refreshTokens[r.PostForm.Get("refresh_token")]
+	if !ok {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "Token has been expired or revoked.")
+		return
+	}
+
+	s.writeToken(w, &grant{email: email}, "")
+}
+
+// handleJWTBearer issues tokens for assertions signed with the key of a
+// service account, the subject is the user impersonated
+func (s *Server) handleJWTBearer(w http.ResponseWriter, r *http.Request) {
+	token, err := jwt.ParseSigned(r.PostForm.Get("assertion"))
+	if err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	var unverified jwt.Claims
+	if err := token.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.serviceAccounts[strings.ToLower(unverified.Issuer)]
+	if !ok {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "Invalid JWT Signature.")
+		return
+	}
+
+	var claims jwt.Claims
+	if err := token.Claims(key.Public(), &claims); err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "Invalid JWT Signature.")
+		return
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Audience: jwt.Audience{s.TokenURL()}, Time: time.Now()}, time.Minute); err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	email := claims.Subject
+	if email == "" {
+		email = claims.Issuer
+	}
+	s.writeToken(w, &grant{email: email, serviceAccount: true}, "")
+}
+
+// writeToken issues an access token for the grant, s.lock is held by the
+// caller
+func (s *Server) writeToken(w http.ResponseWriter, g *grant, refreshToken string) {
+	prefix := "access"
+	if g.serviceAccount {
+		prefix = serviceAccountTokenPrefix + prefix
+	}
+	accessToken := s.newValue(prefix)
+	g.expires = time.Now().Add(s.TokenLifetime)
+	s.accessTokens[accessToken] = g
+
+	resp := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.TokenLifetime / time.Second),
+	}
+	if refreshToken != "" {
+		resp["refresh_token"] = refreshToken
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	token := r.Form.Get("token")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, isAccessToken := s.accessTokens[token]
+	_, isRefreshToken := s.refreshTokens[token]
+	if !isAccessToken && !isRefreshToken {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_token", "Token expired or revoked")
+		return
+	}
+
+	delete(s.accessTokens, token)
+	delete(s.refreshTokens, token)
+	s.revoked = append(s.revoked, token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorized returns the grant of the bearer token of the request
+func (s *Server) authorized(r *http.Request) (*grant, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	g, ok := s.accessTokens[token]
+	if !ok || time.Now().After(g.expires) {
+		return nil, false
+	}
+	return g, true
+}
+
+func (s *Server) handleUserinfo(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.authorized(r)
+	if !ok || g.serviceAccount {
+		writeAPIError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	s.lock.Lock()
+	u, ok := s.users[strings.ToLower(g.email)]
+	s.lock.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":             g.email,
+		"email":          u.Email,
+		"verified_email": true,
+		"name":           u.Name,
+		"hd":             u.HostedDomain,
+	})
+}
+
+func (s *Server) handleCerts(w http.ResponseWriter, r *http.Request) {
+	writeJWKS(w, s.keyID, &s.key.PublicKey)
+}
+
+func (s *Server) handleServiceAccountCerts(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimPrefix(r.URL.Path, serviceAccountCertsPath)
+
+	s.lock.Lock()
+	key, ok := s.serviceAccounts[strings.ToLower(email)]
+	s.lock.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	writeJWKS(w, email, &key.PublicKey)
+}
+
+func writeJWKS(w http.ResponseWriter, keyID string, key *rsa.PublicKey) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       key,
+			KeyID:     keyID,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}},
+	})
+}
+
+// handleDirectory serves the groups list and users get methods of the
+// Directory API to service accounts
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.authorized(r)
+	if !ok || !g.serviceAccount {
+		writeAPIError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	resource := strings.TrimPrefix(r.URL.Path, directoryPath)
+	switch {
+	case resource == "groups":
+		s.handleGroupsList(w, r)
+	case strings.HasPrefix(resource, "users/"):
+		s.handleUsersGet(w, strings.TrimPrefix(resource, "users/"))
+	default:
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) handleGroupsList(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.groupsErrors) > 0 {
+		status := s.groupsErrors[0]
+		s.groupsErrors = s.groupsErrors[1:]
+		writeAPIError(w, status, http.StatusText(status))
+		return
+	}
+
+	userKey := strings.ToLower(r.URL.Query().Get("userKey"))
+	var memberOf []string
+	if u, ok := s.users[userKey]; ok {
+		memberOf = u.Groups
+	} else if g, ok := s.groups[userKey]; ok {
+		memberOf = g.Groups
+	} else {
+		writeAPIError(w, http.StatusNotFound, "Resource Not Found: userKey")
+		return
+	}
+	memberOf = append([]string{}, memberOf...)
+	sort.Strings(memberOf)
+
+	offset := 0
+	if pageToken := r.URL.Query().Get("pageToken"); pageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(pageToken)
+		if err != nil || offset < 0 || offset > len(memberOf) {
+			writeAPIError(w, http.StatusBadRequest, "Invalid pageToken")
+			return
+		}
+	}
+
+	end := offset + s.GroupsPageSize
+	nextPageToken := strconv.Itoa(end)
+	if end >= len(memberOf) {
+		end = len(memberOf)
+		nextPageToken = ""
+	}
+
+	groups := []map[string]interface{}{}
+	for _, email := range memberOf[offset:end] {
+		group := map[string]interface{}{
+			"kind":  "admin#directory#group",
+			"id":    email,
+			"email": email,
+		}
+		if g, ok := s.groups[strings.ToLower(email)]; ok {
+			group["name"] = g.Name
+		}
+		groups = append(groups, group)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":          "admin#directory#groups",
+		"groups":        groups,
+		"nextPageToken": nextPageToken,
+	})
+}
+
+func (s *Server) handleUsersGet(w http.ResponseWriter, userKey string) {
+	s.lock.Lock()
+	u, ok := s.users[strings.ToLower(userKey)]
+	s.lock.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Resource Not Found: userKey")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":            "admin#directory#user",
+		"primaryEmail":    u.Email,
+		"suspended":       u.Suspended,
+		"archived":        u.Archived,
+		"isEnrolledIn2Sv": u.EnrolledIn2SV,
+		"orgUnitPath":     u.OrgUnitPath,
+	})
+}